@@ -2,6 +2,9 @@ import sys
 import collections
 import statistics
 import os
+import gzip
+import io
+import json
 
 # Try to import matplotlib; handle case where it's missing
 try:
@@ -78,6 +81,33 @@ def save_visual_plot(token_counts, filepath):
     print(f"✅ Plot saved successfully.")
 
 
+def dataset_files(filepath):
+    """Expands a writer manifest (<name>.<ext>.manifest.json) into its shard files."""
+    if not filepath.endswith(".manifest.json"):
+        return [filepath], filepath
+
+    with open(filepath, "r", encoding="utf-8") as f:
+        manifest = json.load(f)
+    directory = os.path.dirname(filepath)
+    shards = [os.path.join(directory, shard["file"]) for shard in manifest["shards"]]
+    return shards, filepath[: -len(".manifest.json")]
+
+
+def open_dataset(filepath):
+    """Opens a plain, gzip (.gz) or zstd (.zst) compressed text file."""
+    if filepath.endswith(".gz"):
+        return gzip.open(filepath, "rt", encoding="utf-8", errors="replace")
+    if filepath.endswith(".zst"):
+        try:
+            import zstandard
+        except ImportError:
+            print("❌ Error: .zst shards need the zstandard package. (pip install zstandard)")
+            sys.exit(1)
+        reader = zstandard.ZstdDecompressor().stream_reader(open(filepath, "rb"), closefd=True)
+        return io.TextIOWrapper(reader, encoding="utf-8", errors="replace")
+    return open(filepath, "r", encoding="utf-8", errors="replace")
+
+
 def analyze(filepath):
     print(f"--- 📊 Analyzing {filepath} ---")
 
@@ -88,20 +118,22 @@ def analyze(filepath):
     sample_count = 0
 
     try:
-        with open(filepath, "r", encoding="utf-8", errors="replace") as f:
-            for line in f:
-                stripped = line.strip()
-                if stripped == "<eos>":
-                    if current_tokens > 0:
-                        token_counts.append(current_tokens)
-                        sample_count += 1
-                    current_tokens = 0
-                    continue
-
-                # Update stats
-                current_tokens += len(stripped.split())
-                char_counter.update(line)
-                total_chars += len(line)
+        files, filepath = dataset_files(filepath)
+        for shard in files:
+            with open_dataset(shard) as f:
+                for line in f:
+                    stripped = line.strip()
+                    if stripped == "<eos>":
+                        if current_tokens > 0:
+                            token_counts.append(current_tokens)
+                            sample_count += 1
+                        current_tokens = 0
+                        continue
+
+                    # Update stats
+                    current_tokens += len(stripped.split())
+                    char_counter.update(line)
+                    total_chars += len(line)
 
     except FileNotFoundError:
         print("❌ Error: File not found.")
@@ -140,7 +172,7 @@ def analyze(filepath):
 
 if __name__ == "__main__":
     if len(sys.argv) < 2:
-        print("Usage: python analyze_dataset.py <filepath>")
+        print("Usage: python analyze_dataset.py <filepath | name.manifest.json>")
         sys.exit(1)
 
     analyze(sys.argv[1])
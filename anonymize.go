@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// AnonymizeUsers: Replaces u/name and @name handles in forum samples with pseudonyms
+// that are consistent within a thread (u/user1, u/user2, ...), or with Placeholder
+// when it is set. Threads are told apart by the permalink or question_id metadata.
+// It also strips "EDIT: thanks" style boilerplate and signature blocks. Code blocks
+// and inline code are left untouched.
+type AnonymizeUsers struct {
+	Placeholder string // e.g. "[user]", empty for numbered pseudonyms
+}
+
+var (
+	reRedditHandle = regexp.MustCompile(`(^|[^\w/])(/?u/)([A-Za-z0-9_-]{3,20})\b`)
+	reAtMention    = regexp.MustCompile(`(^|[^\w.@])@(\w[\w.-]*\w)\b`)
+
+	// "EDIT: thanks for the gold", "Update 2 - fixed typo" ...
+	reEditLine  = regexp.MustCompile(`(?i)^\W*(edit|update|eta)\s*\d*\s*[:\-]`)
+	reEditNoise = regexp.MustCompile(`(?i)\b(thanks?|thank you|gold|silver|award|upvotes?|typos?|formatting|spelling|words?)\b`)
+	// Lines that say nothing but thanks: "Thanks in advance!", "thx for the help"
+	reThanksLine = regexp.MustCompile(`(?i)^\W*(many thanks|thanks|thank you|thx|ty|tia)` +
+		`(\s+(so much|very much|a lot|a ton|again|all|everyone|guys|folks|in advance|for reading|` +
+		`for (the|your|any|all the) (help|answers?|replies|advice|input|tips|suggestions?)))*[\s.!:)]*$`)
+	// "Cheers", "Best regards," or "Cheers, Sam": the sign-off word stands alone or
+	// is followed by a comma and a name
+	reSignOff = regexp.MustCompile(`(?i)^\W*(cheers|regards|best regards|kind regards|best|many thanks|thanks)(,\s*[\w.-]+|[,.!])?\s*$`)
+)
+
+// atKeywords are @words that are code rather than people: annotations, decorators,
+// CSS and Sass at-rules and doc tags
+var atKeywords = strings.Fields(`
+	override deprecated suppresswarnings functionalinterface safevarargs
+	test before after beforeeach aftereach beforeall afterall parameterizedtest
+	autowired component service repository controller restcontroller bean configuration
+	entity table id column inject nullable nonnull notnull transactional value
+	data getter setter builder jsonproperty getmapping postmapping requestmapping
+	pathvariable requestbody jvmstatic composable
+	property staticmethod classmethod dataclass abstractmethod cache lru_cache wraps
+	input output injectable ngmodule hostlistener viewchild
+	state binding published observedobject mainactor objc escaping available
+	media import font-face keyframes supports charset layer container page namespace
+	apply tailwind use forward mixin include extend if else each function return
+	param returns throws type typedef see example brief
+`)
+
+// replaceMentions rewrites @name mentions through alias. Mentions followed by "/"
+// or "(" (@angular/core, @decorator(...)) and known code keywords are kept.
+func replaceMentions(text string, alias func(string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range reAtMention.FindAllStringSubmatchIndex(text, -1) {
+		name := text[m[4]:m[5]]
+		if m[1] < len(text) && (text[m[1]] == '/' || text[m[1]] == '(') || slices.Contains(atKeywords, strings.ToLower(name)) {
+			continue
+		}
+		b.WriteString(text[last:m[4]])
+		b.WriteString(alias(name))
+		last = m[5]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// anonymizeTurn rewrites the lines of a single turn, numbering handles through alias
+func anonymizeTurn(lines []string, alias func(string) string) []string {
+	var kept []string
+	fence := 0 // Backticks of the open fence, 0 outside code blocks
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			// Only a bare fence at least as long as the opening one closes the block,
+			// so a "````" block can quote "```go" fences
+			n := len(trimmed) - len(strings.TrimLeft(trimmed, "`"))
+			if fence == 0 {
+				fence = n
+			} else if n >= fence && n == len(trimmed) {
+				fence = 0
+			}
+			kept = append(kept, line)
+			continue
+		}
+		if fence > 0 {
+			kept = append(kept, line)
+			continue
+		}
+
+		// Signatures: everything below a "-- " delimiter
+		if trimmed == "--" {
+			break
+		}
+		if reEditLine.MatchString(trimmed) && reEditNoise.MatchString(trimmed) {
+			continue
+		}
+		if reThanksLine.MatchString(trimmed) {
+			continue
+		}
+
+		// Only text outside `inline code` is rewritten
+		parts := strings.Split(line, "`")
+		for i := 0; i < len(parts); i += 2 {
+			parts[i] = reRedditHandle.ReplaceAllStringFunc(parts[i], func(m string) string {
+				sub := reRedditHandle.FindStringSubmatch(m)
+				return sub[1] + sub[2] + alias(sub[3])
+			})
+			parts[i] = replaceMentions(parts[i], alias)
+		}
+		kept = append(kept, strings.Join(parts, "`"))
+	}
+
+	trimBlank := func() {
+		for len(kept) > 1 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+			kept = kept[:len(kept)-1]
+		}
+	}
+
+	// Sign-offs such as "Cheers," followed by a name at the end of the turn
+	trimBlank()
+	if n := len(kept); n > 1 && reSignOff.MatchString(strings.TrimSpace(kept[n-1])) {
+		kept = kept[:n-1]
+	} else if n > 2 && reSignOff.MatchString(strings.TrimSpace(kept[n-2])) && len(strings.Fields(kept[n-1])) <= 2 {
+		kept = kept[:n-2]
+	}
+	trimBlank()
+	return kept
+}
+
+// newAlias returns the handle mapping for one thread
+func (a *AnonymizeUsers) newAlias() func(string) string {
+	aliases := make(map[string]string)
+	return func(name string) string {
+		if a.Placeholder != "" {
+			return a.Placeholder
+		}
+		key := strings.ToLower(name)
+		if _, ok := aliases[key]; !ok {
+			aliases[key] = fmt.Sprintf("user%d", len(aliases)+1)
+		}
+		return aliases[key]
+	}
+}
+
+// anonymizeTurns rewrites the turns of a dialogue sample
+func (a *AnonymizeUsers) anonymizeTurns(turns []Turn, alias func(string) string) []Turn {
+	result := make([]Turn, len(turns))
+	for i, t := range turns {
+		result[i] = Turn{Role: t.Role, Text: strings.Join(anonymizeTurn(strings.Split(t.Text, "\n"), alias), "\n")}
+	}
+	return result
+}
+
+// anonymizeSample rewrites every turn of a <user>/<bot> sample, or the whole text
+// when it has no turns
+func (a *AnonymizeUsers) anonymizeSample(content string, alias func(string) string) string {
+	var out []string
+	var turn []string
+	prefix := ""
+	flush := func() {
+		if turn == nil {
+			return
+		}
+		lines := anonymizeTurn(turn, alias)
+		if len(lines) == 0 {
+			lines = []string{""}
+		}
+		lines[0] = prefix + lines[0]
+		out = append(out, lines...)
+		turn, prefix = nil, ""
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		switch {
+		case strings.HasPrefix(line, "<user>: "), strings.HasPrefix(line, "<bot>: "):
+			flush()
+			role, text, _ := strings.Cut(line, ": ")
+			prefix = role + ": "
+			turn = []string{text}
+		case line == "<eos>":
+			flush()
+			out = append(out, line)
+		default:
+			turn = append(turn, line)
+		}
+	}
+	flush()
+	return strings.Join(out, "\n")
+}
+
+func (a *AnonymizeUsers) Stage(ctx context.Context, in chan Task) chan Task {
+	out := make(chan Task)
+	go func() {
+		defer close(out)
+		// Extractors emit the samples of a thread together, so only the current
+		// thread's aliases are kept
+		var thread string
+		var threadAlias func(string) string
+		for task := range in {
+			// Samples of one thread share their aliases
+			alias := a.newAlias()
+			if key := cmp.Or(task.Metadata["permalink"], task.Metadata["question_id"]); key != "" {
+				key = task.Metadata["site"] + key
+				if key != thread {
+					thread, threadAlias = key, alias
+				}
+				alias = threadAlias
+			}
+
+			if len(task.Turns) > 0 {
+				task.Turns = a.anonymizeTurns(task.Turns, alias)
+				task.Content = formatDialogue(task.Turns)
+			} else {
+				task.Content = a.anonymizeSample(task.Content, alias)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- task:
+			}
+		}
+	}()
+	return out
+}
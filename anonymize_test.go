@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizeTurn(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "handles",
+			in:   "As u/Gopher_42 and /u/rustacean said, ask @alice_dev. Ping u/gopher_42 again.",
+			want: "As u/user1 and /u/user2 said, ask @user3. Ping u/user1 again.",
+		},
+		{
+			name: "email",
+			in:   "Mail me at bob@example.com.",
+			want: "Mail me at bob@example.com.",
+		},
+		{
+			name: "fenced code",
+			in:   "Try this, u/someone:\n```java\n@Override\nString name = \"u/literal\"; // @alice\n```\nDone.",
+			want: "Try this, u/user1:\n```java\n@Override\nString name = \"u/literal\"; // @alice\n```\nDone.",
+		},
+		{
+			name: "longer fence quoting a fence",
+			in:   "Write it as u/someone did:\n````\n```go\nx := \"@alice\"\n```\nask u/bob\n````\nThanks, u/bob!",
+			want: "Write it as u/user1 did:\n````\n```go\nx := \"@alice\"\n```\nask u/bob\n````\nThanks, u/user2!",
+		},
+		{
+			name: "inline code",
+			in:   "Run `git blame @alice u/bob` and ask @alice.",
+			want: "Run `git blame @alice u/bob` and ask @user1.",
+		},
+		{
+			name: "code tokens",
+			in:   "Add @Override, import @angular/core and @types/node, use @media and @font-face, call @decorator(x).",
+			want: "Add @Override, import @angular/core and @types/node, use @media and @font-face, call @decorator(x).",
+		},
+		{
+			name: "edit lines",
+			in:   "Use a mutex.\nEDIT: thanks for the gold!\nUpdate 2 - fixed typo\nEdit: it also needs a sync.Once.",
+			want: "Use a mutex.\nEdit: it also needs a sync.Once.",
+		},
+		{
+			name: "thanks lines",
+			in:   "Thanks in advance!\nHow do I profile this?\nthanks!\nThanks for the help :)",
+			want: "How do I profile this?",
+		},
+		{
+			name: "thanks in a sentence",
+			in:   "Thanks to the new GC, latency dropped.\nTy Cobb was great.\nThanks, that fixed it because the buffer was full.",
+			want: "Thanks to the new GC, latency dropped.\nTy Cobb was great.\nThanks, that fixed it because the buffer was full.",
+		},
+		{
+			name: "sign-off with name",
+			in:   "Use a buffered channel.\n\nCheers,\nSam",
+			want: "Use a buffered channel.",
+		},
+		{
+			name: "sign-off on one line",
+			in:   "Use a buffered channel.\nBest regards, Sam",
+			want: "Use a buffered channel.",
+		},
+		{
+			name: "sign-off word in content",
+			in:   "Which approach is idiomatic?\nBest practice",
+			want: "Which approach is idiomatic?\nBest practice",
+		},
+		{
+			name: "signature block",
+			in:   "Use a buffered channel.\n--\nSam | Gopher since 2012",
+			want: "Use a buffered channel.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Join(anonymizeTurn(strings.Split(tt.in, "\n"), (&AnonymizeUsers{}).newAlias()), "\n")
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymizeUsersPerThread(t *testing.T) {
+	sample := func(permalink, answer string) Task {
+		return Task{
+			Turns:    []Turn{{"user", "Who maintains this package?"}, {"bot", answer}},
+			Metadata: map[string]string{"permalink": permalink},
+		}
+	}
+	out := runStage(t, &AnonymizeUsers{},
+		sample("/r/golang/comments/a/", "Ask u/carol, she reviews with u/dave."),
+		sample("/r/golang/comments/a/", "u/dave does, not u/carol."),
+		sample("/r/golang/comments/b/", "u/dave wrote it."),
+		sample("/r/golang/comments/a/", "u/dave wrote it."),
+	)
+
+	var got []string
+	for _, task := range out {
+		got = append(got, task.Turns[1].Text)
+		if task.Content != formatDialogue(task.Turns) {
+			t.Errorf("content not re-rendered: %q", task.Content)
+		}
+	}
+	// Aliases carry over between samples of a thread and restart with the next one.
+	// Only the current thread is remembered, a thread seen again starts over.
+	want := []string{"Ask u/user1, she reviews with u/user2.", "u/user2 does, not u/user1.", "u/user1 wrote it.", "u/user1 wrote it."}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
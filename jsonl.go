@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+)
+
+// JSONLSchemaVersion is written into every WriteJSONL record. Bump it whenever a
+// field is added, removed or changes meaning; the schema is documented in the README.
+const JSONLSchemaVersion = 1
+
+// WriteJSONL: Writes one JSON object per line: id, source, url, text for prose or
+// messages for dialogues, and metadata
+type WriteJSONL struct {
+	Filepath string
+	Sharding // Optional shard rotation and compression
+}
+
+type jsonlMessage struct {
+	Role    string `json:"role"` // "user" or "assistant"
+	Content string `json:"content"`
+}
+
+type jsonlRecord struct {
+	SchemaVersion int               `json:"schema_version"`
+	ID            string            `json:"id"`
+	Source        string            `json:"source"`
+	URL           string            `json:"url,omitempty"`
+	Text          string            `json:"text,omitempty"`
+	Messages      []jsonlMessage    `json:"messages,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// newJSONLRecord converts a task to the JSONL schema
+func newJSONLRecord(task Task) jsonlRecord {
+	record := jsonlRecord{
+		SchemaVersion: JSONLSchemaVersion,
+		ID:            task.ID,
+		Source:        sampleSource(task.ID),
+		URL:           task.URL,
+		Metadata:      task.Metadata,
+	}
+	if len(task.Turns) == 0 {
+		record.Text = task.Content
+		return record
+	}
+	for _, t := range task.Turns {
+		role := t.Role
+		if role == "bot" {
+			role = "assistant"
+		}
+		record.Messages = append(record.Messages, jsonlMessage{Role: role, Content: t.Text})
+	}
+	return record
+}
+
+func (w *WriteJSONL) Stage(ctx context.Context, in chan Task) chan Task {
+	out := make(chan Task)
+	go func() {
+		defer close(out)
+		writer, err := newShardWriter(w.Filepath, w.Sharding)
+		if err != nil {
+			log.Println("Error creating file=", w.Filepath, " with error=", err)
+			return
+		}
+		defer func() {
+			if err := writer.Close(); err != nil {
+				log.Println("Error closing file=", w.Filepath, " with error=", err)
+			}
+		}()
+
+		// Each line is encoded on its own, so shards always end on a full record
+		var line bytes.Buffer
+		encoder := json.NewEncoder(&line)
+		encoder.SetEscapeHTML(false)
+
+		count := 0
+		for task := range in {
+			line.Reset()
+			err := encoder.Encode(newJSONLRecord(task))
+			if err == nil {
+				err = writer.Write(line.Bytes())
+			}
+			if err != nil {
+				log.Println("Error writing to file=", w.Filepath, " with error=", err)
+				return
+			}
+			count++
+			select {
+			case <-ctx.Done():
+				log.Println("Stopping writing to file due to ctx cancelled")
+				return
+			case out <- task:
+			}
+		}
+		log.Println("Total records written:", count, "to", w.Filepath)
+	}()
+	return out
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteJSONLRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dataset.jsonl")
+	turns := []Turn{{"user", "How do I close a channel?"}, {"bot", "With close(ch)."}, {"user", "And twice?"}, {"bot", "It panics."}}
+	tasks := []Task{
+		{
+			ID:       SampleID("wiki", "https://en.wikipedia.org/wiki/Go_(programming_language)"),
+			URL:      "https://en.wikipedia.org/wiki/Go_(programming_language)",
+			Content:  "# Go (programming language)\n\nChannels use the <- operator & \"select\".",
+			Metadata: map[string]string{"kind": "article", "title": "Go (programming language)"},
+		},
+		{
+			ID:       SampleID("stackexchange", "stackoverflow.com", "1", "3"),
+			Content:  formatDialogue(turns),
+			Turns:    turns,
+			Metadata: map[string]string{"site": "stackoverflow.com", "question_id": "1", "answer_id": "3"},
+		},
+		{
+			ID:      SampleID("reddit", "/r/golang/comments/abc/", "c1"),
+			URL:     "https://www.reddit.com/r/golang/comments/abc/",
+			Content: formatDialogue(turns[:2]),
+			Turns:   turns[:2],
+		},
+	}
+	out := runStage(t, &WriteJSONL{Filepath: path}, tasks...)
+	if len(out) != len(tasks) {
+		t.Fatalf("passed on %d tasks, want %d", len(out), len(tasks))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != len(tasks) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(tasks))
+	}
+
+	// Prose is written as text, with its characters unescaped
+	if !strings.Contains(lines[0], `the <- operator & \"select\".`) {
+		t.Errorf("text was escaped: %s", lines[0])
+	}
+
+	for i, task := range tasks {
+		var got jsonlRecord
+		if err := json.Unmarshal([]byte(lines[i]), &got); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if got.SchemaVersion != JSONLSchemaVersion || got.ID != task.ID || got.URL != task.URL || !maps.Equal(got.Metadata, task.Metadata) {
+			t.Errorf("line %d: got %+v", i, got)
+		}
+		// The source is the namespace of the ID
+		if want := strings.Split(task.ID, "-")[0]; got.Source != want {
+			t.Errorf("line %d: source = %q, want %q", i, got.Source, want)
+		}
+
+		if len(task.Turns) == 0 {
+			if got.Text != task.Content || got.Messages != nil {
+				t.Errorf("line %d: text = %q with %d messages", i, got.Text, len(got.Messages))
+			}
+			continue
+		}
+		// Dialogues are written as messages only, the bot answering as the assistant
+		var want []jsonlMessage
+		for j, turn := range task.Turns {
+			role := "user"
+			if j%2 == 1 {
+				role = "assistant"
+			}
+			want = append(want, jsonlMessage{Role: role, Content: turn.Text})
+		}
+		if got.Text != "" || !slices.Equal(got.Messages, want) {
+			t.Errorf("line %d: text = %q, messages = %q, want %q", i, got.Text, got.Messages, want)
+		}
+	}
+}
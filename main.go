@@ -4,16 +4,17 @@ import (
 	"context"
 	"log"
 	"regexp"
+	"strings"
 )
 
 // --- GLOBALS ---
-var mode string = "wiki" // Options: "wiki", "reddit", "stack"
+var mode string = "wiki" // Options: "wiki", "reddit", "reddit-json", "reddit-dump", "stack"
 var pythonCmd string = "python"
+var output string = "text" // Options: "text", "jsonl", "parquet"
 
 var (
     reSpace    = regexp.MustCompile(`[ \t]+`)
     reNewlines = regexp.MustCompile(`\n{3,}`)
-    tagRegex = regexp.MustCompile(`<[^>]*>`)
 )
 
 func main() {
@@ -26,7 +27,7 @@ func main() {
         stages = []Pipeline{
             &StreamURL{Filepath: "urls.txt"},
             &DownloadURL{NumWorkers: 20},
-            &ExtractTextWiki{},
+            &ExtractTextWiki{DropKinds: []string{PageDisambiguation}},
             &WritePlainText{Filepath: "dataset_wiki.txt"},
             &AnalyzeDataset{Filepath: "dataset_wiki.txt", PythonPath: pythonCmd},
         }
@@ -40,24 +41,85 @@ func main() {
                 Target:       5000,
             },
             &DownloadURL{NumWorkers: 20},
-            &ExtractTextReddit{},                    
+            &ExtractTextReddit{},
+            &FilterReddit{DefaultQuota: 500}, // Drops NSFW/quarantined threads, caps each subreddit
+            &AnonymizeUsers{},
+            &WriteQA{Filepath: "dataset_reddit.txt"},
+            &AnalyzeDataset{Filepath: "dataset_reddit.txt", PythonPath: pythonCmd},
+        }
+    case "reddit-json":
+        stages = []Pipeline{
+            &FetchLinks{
+                CCIndex:      "CC-MAIN-2023-50",
+                NumPages:     15,
+                Label:        "Reddit",
+                QueryPattern: "*.reddit.com/r/*/comments/*/*/*",
+                Target:       5000,
+                RedditJSON:   true, // Read <permalink>.json instead of scraping HTML
+            },
+            &DownloadURL{NumWorkers: 20},
+            &ExtractTextReddit{},
+            &FilterReddit{DefaultQuota: 500},
+            &AnonymizeUsers{},
+            &WriteQA{Filepath: "dataset_reddit.txt"},
+            &AnalyzeDataset{Filepath: "dataset_reddit.txt", PythonPath: pythonCmd},
+        }
+    case "reddit-dump":
+        stages = []Pipeline{
+            &StreamRedditDumps{Directory: "./reddit_dump"}, // RS_*.zst and RC_*.zst archives
+            &FilterReddit{DefaultQuota: 500},
+            &AnonymizeUsers{},
             &WriteQA{Filepath: "dataset_reddit.txt"},
             &AnalyzeDataset{Filepath: "dataset_reddit.txt", PythonPath: pythonCmd},
         }
     case "stack":
         stages = []Pipeline{
             &StreamXMLFiles{Directory: "./xml_dump"},
-            &ProcessStackExchangeXML{MinScore: 1},
+            &ProcessStackExchangeXML{MinAnswerScore: 1, DropNegative: true, DropClosed: true, DropDuplicates: true, DropCommunityWiki: true},
+            &AnonymizeUsers{},
             &WriteQA{Filepath: "dataset_stackoverflow.txt"},
             &AnalyzeDataset{Filepath: "dataset_stackoverflow.txt", PythonPath: pythonCmd},
         }
     }
 
+    // JSONL and Parquet replace the text writers; the analysis script only reads text
+    if output == "jsonl" || output == "parquet" {
+        var converted []Pipeline
+        for _, stage := range stages {
+            var path string
+            var sharding Sharding
+            switch s := stage.(type) {
+            case *WritePlainText:
+                path, sharding = s.Filepath, s.Sharding
+            case *WriteQA:
+                path, sharding = s.Filepath, s.Sharding
+            case *AnalyzeDataset:
+                continue
+            default:
+                converted = append(converted, stage)
+                continue
+            }
+
+            path = strings.TrimSuffix(path, ".txt")
+            if output == "parquet" {
+                // Parquet compresses its columns, so the shard compression picks the codec
+                converted = append(converted, &WriteParquet{
+                    Filepath:    path + ".parquet",
+                    Compression: sharding.Compression,
+                    Sharding:    Sharding{MaxBytes: sharding.MaxBytes, MaxRecords: sharding.MaxRecords},
+                })
+            } else {
+                converted = append(converted, &WriteJSONL{Filepath: path + ".jsonl", Sharding: sharding})
+            }
+        }
+        stages = converted
+    }
+
     // Run
     log.Printf("Starting Pipeline in %s mode...\n", mode)
     finalChan := RunPipeline(ctx, stages...)
 
     for task := range finalChan {
-        log.Printf("[%s] Processed Task ID: %d | Size: %d bytes", mode, task.ID, len(task.Content))
+        log.Printf("[%s] Processed Task ID: %s | Size: %d bytes", mode, task.ID, len(task.Content))
     }
 }
\ No newline at end of file
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var reInlineSpace = regexp.MustCompile(`\s+`)
+
+// htmlToMarkdown converts an HTML post body (as found in Stack Exchange dumps) to
+// Markdown. <pre> blocks become fenced code blocks with their whitespace intact,
+// inline code keeps its backticks, and lists, blockquotes, headings and link text
+// keep their structure instead of being flattened into prose.
+func htmlToMarkdown(body string) string {
+	root := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(body), root)
+	if err != nil {
+		return strings.TrimSpace(body)
+	}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+	return strings.Join(markdownBlocks(root), "\n\n")
+}
+
+// isMarkdownBlock reports whether n starts a block of its own
+func isMarkdownBlock(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Pre, atom.Ul, atom.Ol, atom.Blockquote, atom.Div, atom.Hr, atom.Table,
+		atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Dl:
+		return true
+	}
+	return false
+}
+
+// markdownBlocks renders the children of n as a list of Markdown blocks
+func markdownBlocks(n *html.Node) []string {
+	var blocks []string
+	var para strings.Builder
+
+	flush := func() {
+		if text := strings.TrimSpace(para.String()); text != "" {
+			blocks = append(blocks, text)
+		}
+		para.Reset()
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !isMarkdownBlock(c) {
+			para.WriteString(markdownInline(c))
+			continue
+		}
+		flush()
+
+		switch c.DataAtom {
+		case atom.P:
+			if text := strings.TrimSpace(markdownInlineChildren(c)); text != "" {
+				blocks = append(blocks, text)
+			}
+		case atom.Pre:
+			blocks = append(blocks, markdownCodeBlock(c))
+		case atom.Ul, atom.Ol:
+			if list := markdownList(c); list != "" {
+				blocks = append(blocks, list)
+			}
+		case atom.Blockquote:
+			var lines []string
+			for _, line := range strings.Split(strings.Join(markdownBlocks(c), "\n\n"), "\n") {
+				lines = append(lines, strings.TrimRight("> "+line, " "))
+			}
+			blocks = append(blocks, strings.Join(lines, "\n"))
+		case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			level := int(c.Data[1] - '0')
+			if text := strings.TrimSpace(markdownInlineChildren(c)); text != "" {
+				blocks = append(blocks, strings.Repeat("#", level)+" "+text)
+			}
+		case atom.Hr:
+			blocks = append(blocks, "---")
+		case atom.Table:
+			if table := markdownTable(c); table != "" {
+				blocks = append(blocks, table)
+			}
+		default:
+			blocks = append(blocks, markdownBlocks(c)...)
+		}
+	}
+	flush()
+	return blocks
+}
+
+// markdownInlineChildren renders the children of n as inline text
+func markdownInlineChildren(n *html.Node) string {
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(markdownInline(c))
+	}
+	return sb.String()
+}
+
+// markdownInline renders n as inline text; whitespace collapses like in a browser
+func markdownInline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return reInlineSpace.ReplaceAllString(n.Data, " ")
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.Code, atom.Kbd:
+		// A code span that contains backticks needs a longer fence
+		code := nodeText(n)
+		if strings.Contains(code, "`") {
+			return "`` " + code + " ``"
+		}
+		return "`" + code + "`"
+	case atom.Strong, atom.B:
+		if text := strings.TrimSpace(markdownInlineChildren(n)); text != "" {
+			return "**" + text + "**"
+		}
+		return ""
+	case atom.Em, atom.I:
+		if text := strings.TrimSpace(markdownInlineChildren(n)); text != "" {
+			return "*" + text + "*"
+		}
+		return ""
+	case atom.Br:
+		return "\n"
+	case atom.Img:
+		for _, a := range n.Attr {
+			if a.Key == "alt" {
+				return a.Val
+			}
+		}
+		return ""
+	case atom.Script, atom.Style:
+		return ""
+	}
+	// Links and everything else keep their text only
+	return markdownInlineChildren(n)
+}
+
+// markdownCodeBlock fences a <pre> block, keeping its text byte for byte
+func markdownCodeBlock(pre *html.Node) string {
+	lang := ""
+	for _, n := range []*html.Node{pre, pre.FirstChild} {
+		if n == nil || n.Type != html.ElementNode {
+			continue
+		}
+		for _, a := range n.Attr {
+			if a.Key != "class" {
+				continue
+			}
+			for _, class := range strings.Fields(a.Val) {
+				if l, ok := strings.CutPrefix(class, "lang-"); ok && lang == "" {
+					lang = l
+				}
+				if l, ok := strings.CutPrefix(class, "language-"); ok && lang == "" {
+					lang = l
+				}
+			}
+		}
+	}
+
+	code := strings.TrimRight(nodeText(pre), "\n")
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + code + "\n" + fence
+}
+
+// markdownList renders ul/ol items, indenting nested blocks under their marker
+func markdownList(list *html.Node) string {
+	var items []string
+	n := 0
+	for _, a := range list.Attr {
+		if a.Key == "start" {
+			if start, err := strconv.Atoi(a.Val); err == nil {
+				n = start - 1
+			}
+		}
+	}
+
+	for li := list.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.DataAtom != atom.Li {
+			continue
+		}
+		marker := "-"
+		if list.DataAtom == atom.Ol {
+			n++
+			marker = strconv.Itoa(n) + "."
+		}
+
+		content := strings.Join(markdownBlocks(li), "\n")
+		indent := strings.Repeat(" ", len(marker)+1)
+		lines := strings.Split(content, "\n")
+		for i := 1; i < len(lines); i++ {
+			if lines[i] != "" {
+				lines[i] = indent + lines[i]
+			}
+		}
+		items = append(items, marker+" "+strings.Join(lines, "\n"))
+	}
+	return strings.Join(items, "\n")
+}
+
+// markdownTable renders a table as a pipe table, the first row being the header.
+// Pipes inside cells are escaped and line breaks become spaces, so a cell can't
+// split its row.
+func markdownTable(table *html.Node) string {
+	var rows []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c.DataAtom == atom.Tr {
+				var cells []string
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+						text := strings.TrimSpace(markdownInlineChildren(cell))
+						text = strings.ReplaceAll(text, "|", `\|`)
+						cells = append(cells, strings.ReplaceAll(text, "\n", " "))
+					}
+				}
+				if len(cells) == 0 {
+					continue
+				}
+				rows = append(rows, "| "+strings.Join(cells, " | ")+" |")
+				if len(rows) == 1 {
+					rows = append(rows, "|"+strings.Repeat(" --- |", len(cells)))
+				}
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(table)
+	return strings.Join(rows, "\n")
+}
+
+// nodeText returns the raw text below n, whitespace included
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		if n.Type == html.ElementNode && n.DataAtom == atom.Br {
+			sb.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
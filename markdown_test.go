@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestHTMLToMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "paragraphs",
+			in:   "<p>Use   a <strong>buffered</strong>\n channel.</p><p>Or <em>don't</em>.</p>",
+			want: "Use a **buffered** channel.\n\nOr *don't*.",
+		},
+		{
+			name: "pre keeps whitespace",
+			in:   "<pre class=\"lang-go prettyprint-override\"><code>func main() {\n\tif x  {\n\t\treturn   // aligned\n\t}\n\n}\n</code></pre>",
+			want: "```go\nfunc main() {\n\tif x  {\n\t\treturn   // aligned\n\t}\n\n}\n```",
+		},
+		{
+			name: "pre with entities and markup",
+			in:   "<pre><code>if a &lt; b &amp;&amp; <b>c</b> {\n    ch &lt;- v\n}</code></pre>",
+			want: "```\nif a < b && c {\n    ch <- v\n}\n```",
+		},
+		{
+			name: "pre containing a fence",
+			in:   "<pre><code>```go\nx := 1\n```</code></pre>",
+			want: "````\n```go\nx := 1\n```\n````",
+		},
+		{
+			name: "inline code",
+			in:   "<p>Call <code>v, ok := &lt;-ch</code> first.</p>",
+			want: "Call `v, ok := <-ch` first.",
+		},
+		{
+			name: "inline code with backticks",
+			in:   "<p>Quote it as <code>`go test`</code> in Markdown.</p>",
+			want: "Quote it as `` `go test` `` in Markdown.",
+		},
+		{
+			name: "nested lists",
+			in:   "<ul><li>one<ul><li>inner <code>x</code></li><li>inner two</li></ul></li><li>two</li></ul><ol start=\"3\"><li>three</li><li><p>four</p><pre><code>code\n  indented</code></pre></li></ol>",
+			want: "- one\n  - inner `x`\n  - inner two\n- two\n\n3. three\n4. four\n   ```\n   code\n     indented\n   ```",
+		},
+		{
+			name: "blockquotes",
+			in:   "<blockquote><p>First line.</p><p>Second <code>x</code>.</p><blockquote><p>Nested.</p></blockquote></blockquote><p>After.</p>",
+			want: "> First line.\n>\n> Second `x`.\n>\n> > Nested.\n\nAfter.",
+		},
+		{
+			name: "table",
+			in:   "<table><tr><th>a</th><th>b</th></tr><tr><td>1</td><td>2</td></tr></table>",
+			want: "| a | b |\n| --- | --- |\n| 1 | 2 |",
+		},
+		{
+			name: "table with body and pipes",
+			in:   "<p>Operators:</p><table><thead><tr><th>Op</th><th>Meaning</th></tr></thead><tbody><tr><td><code>a || b</code></td><td>or,<br>short-circuit</td></tr><tr><td><code>a | b</code></td><td>bitwise <em>or</em></td></tr></tbody></table>",
+			want: "Operators:\n\n| Op | Meaning |\n| --- | --- |\n| `a \\|\\| b` | or, short-circuit |\n| `a \\| b` | bitwise *or* |",
+		},
+		{
+			name: "headings, rules and links",
+			in:   "<h2>Setup</h2><p>See <a href=\"https://go.dev\">the docs</a>.</p><hr><p>Done<br>now.</p>",
+			want: "## Setup\n\nSee the docs.\n\n---\n\nDone\nnow.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToMarkdown(tt.in); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// WriteParquet: Writes samples to a Parquet file with the columns id, source, url,
+// text, token_count and metadata. Rows are streamed out one row group at a time,
+// so only the current row group is held in memory.
+type WriteParquet struct {
+	Filepath     string
+	RowGroupSize int64  // Rows per row group (0 = 100000)
+	Compression  string // "zstd" (default), "snappy", "gzip" or "none"
+	// Sharding rotates to a new Parquet file by MaxRecords or MaxBytes (counted
+	// before compression) and lists the files in a manifest. Its Compression must
+	// stay empty, columns are compressed by Compression above.
+	Sharding
+}
+
+// parquetRow is the Parquet schema; text is the same rendering WriteQA and
+// WritePlainText produce, token_count counts whitespace-separated words
+type parquetRow struct {
+	ID         string            `parquet:"id"`
+	Source     string            `parquet:"source"`
+	URL        string            `parquet:"url"`
+	Text       string            `parquet:"text"`
+	TokenCount int64             `parquet:"token_count"`
+	Metadata   map[string]string `parquet:"metadata"`
+}
+
+// parquetCodecs maps the Compression option to codecs
+var parquetCodecs = map[string]compress.Codec{
+	"":       &parquet.Zstd,
+	"zstd":   &parquet.Zstd,
+	"snappy": &parquet.Snappy,
+	"gzip":   &parquet.Gzip,
+	"none":   &parquet.Uncompressed,
+}
+
+func (w *WriteParquet) Stage(ctx context.Context, in chan Task) chan Task {
+	out := make(chan Task)
+	go func() {
+		defer close(out)
+
+		codec, ok := parquetCodecs[strings.ToLower(w.Compression)]
+		if !ok {
+			log.Println("Unknown Parquet compression:", w.Compression)
+			return
+		}
+		if w.Sharding.Compression != "" {
+			log.Println("Parquet shards can't be compressed as a whole, use Compression instead of Sharding.Compression")
+			return
+		}
+		rowGroupSize := w.RowGroupSize
+		if rowGroupSize == 0 {
+			rowGroupSize = 100000
+		}
+
+		shards, err := newShardWriter(w.Filepath, w.Sharding)
+		if err != nil {
+			log.Println("Error creating file=", w.Filepath, " with error=", err)
+			return
+		}
+
+		// Every shard is a Parquet file of its own, closed with its footer before
+		// the next one starts
+		var writer *parquet.GenericWriter[parquetRow]
+		newWriter := func() error {
+			// Opened up front, the writer may hold its first bytes until a row group is flushed
+			if err := shards.open(); err != nil {
+				return err
+			}
+			writer = parquet.NewGenericWriter[parquetRow](shards.raw(),
+				parquet.Compression(codec),
+				parquet.MaxRowsPerRowGroup(rowGroupSize),
+			)
+			return nil
+		}
+		closeWriter := func() error {
+			// Close writes the last row group and the footer, without it the file is unreadable
+			err := writer.Close()
+			writer = nil
+			return err
+		}
+		defer func() {
+			// A run without rows still leaves one valid, empty file
+			if writer == nil && len(shards.shards) == 0 {
+				if err := newWriter(); err != nil {
+					log.Println("Error creating file=", w.Filepath, " with error=", err)
+					return
+				}
+			}
+			if writer != nil {
+				if err := closeWriter(); err != nil {
+					log.Println("Error closing file=", w.Filepath, " with error=", err)
+				}
+			}
+			if err := shards.Close(); err != nil {
+				log.Println("Error closing file=", w.Filepath, " with error=", err)
+			}
+		}()
+
+		count := 0
+		for task := range in {
+			if shards.full() {
+				err := closeWriter()
+				if err == nil {
+					err = shards.finish()
+				}
+				if err != nil {
+					log.Println("Error writing to file=", w.Filepath, " with error=", err)
+					return
+				}
+			}
+			if writer == nil {
+				if err := newWriter(); err != nil {
+					log.Println("Error creating file=", w.Filepath, " with error=", err)
+					return
+				}
+			}
+
+			row := parquetRow{
+				ID:         task.ID,
+				Source:     sampleSource(task.ID),
+				URL:        task.URL,
+				Text:       task.Content,
+				TokenCount: int64(countTokens(task.Content)),
+				Metadata:   task.Metadata,
+			}
+			if _, err := writer.Write([]parquetRow{row}); err != nil {
+				log.Println("Error writing to file=", w.Filepath, " with error=", err)
+				return
+			}
+			shards.count(int64(len(row.ID) + len(row.URL) + len(row.Text)))
+			count++
+			select {
+			case <-ctx.Done():
+				log.Println("Stopping writing to file due to ctx cancelled")
+				return
+			case out <- task:
+			}
+		}
+		log.Println("Total records written:", count, "to", w.Filepath)
+	}()
+	return out
+}
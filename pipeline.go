@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,10 +26,12 @@ type DownloadURL struct {
 
 type WritePlainText struct {
 	Filepath string
+	Sharding // Optional shard rotation and compression
 }
 
 type WriteQA struct {
     Filepath string
+    Sharding // Optional shard rotation and compression
 }
 
 type AnalyzeDataset struct {
@@ -36,10 +41,51 @@ type AnalyzeDataset struct {
 
 // Task represents a unit of work in the pipeline
 type Task struct {
-	ID      int
+	ID      string // Stable sample ID, see SampleID
 	URL     string
 	Source  string
 	Content string
+	// Turns holds the messages of dialogue samples; Content is then their
+	// formatDialogue rendering
+	Turns []Turn
+	// Metadata carries per-sample details recorded by the extractors
+	Metadata map[string]string
+}
+
+// SampleID derives a stable ID from a source namespace ("wiki", "reddit",
+// "stackexchange", ...) and the keys that identify a record within that source, e.g.
+// SampleID("stackexchange", "superuser.com", "123", "456"). The same record gets
+// the same ID on every run, and namespaces keep merged pipelines from colliding.
+func SampleID(namespace string, keys ...string) string {
+	h := sha256.New()
+	h.Write([]byte(namespace))
+	for _, key := range keys {
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+	}
+	return namespace + "-" + hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// sampleSource returns the namespace a SampleID was built with
+func sampleSource(id string) string {
+	namespace, _, _ := strings.Cut(id, "-")
+	return namespace
+}
+
+// Turn is one message of a dialogue sample, Role is "user" or "bot"
+type Turn struct {
+	Role string
+	Text string
+}
+
+// formatDialogue renders turns in the <user>/<bot>/<eos> markup written by WriteQA
+func formatDialogue(turns []Turn) string {
+	var sb strings.Builder
+	for _, t := range turns {
+		sb.WriteString("<" + t.Role + ">: " + t.Text + "\n")
+	}
+	sb.WriteString("<eos>\n")
+	return sb.String()
 }
 
 type Pipeline interface {
@@ -67,15 +113,13 @@ func (s *StreamURL) Stage(ctx context.Context, in chan Task) chan Task {
 
 		scanner := bufio.NewScanner(file)
 		// scanner.Scan() // Read header
-		id := 0
 
 		for scanner.Scan() {
 			select {
 			case <-ctx.Done():
 				log.Println("Stopping CSV reading due to ctx cancelled")
 				return
-			case out <- Task{ID: id, URL: scanner.Text()}:
-				id++
+			case out <- Task{ID: SampleID("url", scanner.Text()), URL: scanner.Text()}:
 			}
 		}
 
@@ -159,15 +203,16 @@ func (w *WritePlainText) Stage(ctx context.Context, in chan Task) chan Task {
     out := make(chan Task)
     go func() {
         defer close(out)
-        file, err := os.Create(w.Filepath)
+        writer, err := newShardWriter(w.Filepath, w.Sharding)
         if err != nil {
             log.Println("Error creating file=", w.Filepath, " with error=", err)
             return
         }
-        defer file.Close()
-
-        writer := bufio.NewWriter(file)
-        defer writer.Flush()
+        defer func() {
+            if err := writer.Close(); err != nil {
+                log.Println("Error closing file=", w.Filepath, " with error=", err)
+            }
+        }()
 
         for task := range in {
             select {
@@ -176,7 +221,7 @@ func (w *WritePlainText) Stage(ctx context.Context, in chan Task) chan Task {
                 return
             default:
             }
-            _, err := writer.WriteString(task.Content + "\n\n" + "\n\n<eos>\n")
+            err := writer.Write([]byte(task.Content + "\n\n" + "\n\n<eos>\n"))
             if err != nil {
                 log.Println("Error writing to file=", w.Filepath, " with error=", err)
                 return
@@ -207,7 +252,7 @@ func (a *AnalyzeDataset) Stage(ctx context.Context, in chan Task) chan Task {
             case <-ctx.Done():
                 return
             default:
-                log.Printf("Analyzing Dataset: Received Task ID %d\n", task.ID)
+                log.Printf("Analyzing Dataset: Received Task ID %s\n", task.ID)
                 out <- task
             }
         }
@@ -216,7 +261,12 @@ func (a *AnalyzeDataset) Stage(ctx context.Context, in chan Task) chan Task {
         // The channel 'in' is closed, meaning the file is fully written.
         log.Println("Pipeline finished. Triggering Python analysis...")
 
-        cmd := exec.Command(a.PythonPath, "analyze_dataset.py", a.Filepath)
+        // The writers list their (possibly sharded or compressed) output in a manifest
+        target := a.Filepath
+        if _, err := os.Stat(manifestPath(a.Filepath)); err == nil {
+            target = manifestPath(a.Filepath)
+        }
+        cmd := exec.Command(a.PythonPath, "analyze_dataset.py", target)
 
         // Connect Python output to Go's stdout
         cmd.Stdout = os.Stdout
@@ -234,15 +284,16 @@ func (w *WriteQA) Stage(ctx context.Context, in chan Task) chan Task {
     go func() {
         defer close(out)
 
-        file, err := os.Create(w.Filepath)
+        writer, err := newShardWriter(w.Filepath, w.Sharding)
         if err != nil {
             log.Println("Error creating output file:", err)
             return
         }
-        defer file.Close()
-
-        writer := bufio.NewWriter(file)
-        defer writer.Flush()
+        defer func() {
+            if err := writer.Close(); err != nil {
+                log.Println("Error closing output file:", err)
+            }
+        }()
 
         count := 0
         for task := range in {
@@ -251,7 +302,7 @@ func (w *WriteQA) Stage(ctx context.Context, in chan Task) chan Task {
                 return
             default:
                 // Write formatted content
-                _, err := writer.WriteString(task.Content)
+                err := writer.Write([]byte(task.Content))
                 if err != nil {
                     log.Println("Error writing to file:", err)
                     return
@@ -3,10 +3,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
+	"html"
+	"log"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,7 +21,122 @@ import (
 )
 
 // Stage to extract Reddit Q&A pairs
-type ExtractTextReddit struct{}
+type ExtractTextReddit struct {
+	// MultiTurn emits one dialogue per top-level comment, following its reply
+	// chain, instead of pairing the post with the first comment only. A dialogue
+	// has two speakers: the OP is the user and the top-level commenter the bot.
+	// Each turn is the best-scored reply by whoever speaks next, and the chain
+	// ends where that person didn't reply. Without a known OP or commenter the
+	// dialogue is a single exchange.
+	MultiTurn bool
+	// MaxDepth limits how many comment levels a dialogue follows (0 = no limit)
+	MaxDepth int
+	// MinLength is the length every turn must exceed (0 = 10 characters)
+	MinLength int
+	// MinScore is the lowest comment score that can be picked as a reply
+	MinScore int
+}
+
+// FilterReddit: Keeps Reddit samples by subreddit and drops NSFW and quarantined
+// threads. It reads the metadata written by the Reddit extractors and falls back to
+// the /r/<name>/ part of the URL, so it can also sit in front of DownloadURL.
+type FilterReddit struct {
+	Allow []string // Only these subreddits are kept when non-empty
+	Deny  []string // These subreddits are always dropped
+	// Quotas caps the number of threads per subreddit, counted by permalink, so
+	// every sample of a thread that is let in is kept. DefaultQuota applies to
+	// subreddits that are not listed (0 = unlimited)
+	Quotas           map[string]int
+	DefaultQuota     int
+	AllowNSFW        bool
+	AllowQuarantined bool
+}
+
+// subredditFromURL returns the name in .../r/<name>/... or an empty string
+func subredditFromURL(link string) string {
+	_, rest, found := strings.Cut(link, "/r/")
+	if !found {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return name
+}
+
+func (f *FilterReddit) Stage(ctx context.Context, in chan Task) chan Task {
+	out := make(chan Task)
+
+	allow := make(map[string]bool)
+	for _, name := range f.Allow {
+		allow[strings.ToLower(name)] = true
+	}
+	deny := make(map[string]bool)
+	for _, name := range f.Deny {
+		deny[strings.ToLower(name)] = true
+	}
+	quotas := make(map[string]int)
+	for name, quota := range f.Quotas {
+		quotas[strings.ToLower(name)] = quota
+	}
+
+	go func() {
+		defer close(out)
+		threads := make(map[string]map[string]bool) // Threads let in, by subreddit
+		dropped := make(map[string]int)
+
+		for task := range in {
+			subreddit := task.Metadata["subreddit"]
+			if subreddit == "" {
+				subreddit = subredditFromURL(task.URL)
+			}
+			key := strings.ToLower(subreddit)
+			thread := cmp.Or(task.Metadata["permalink"], task.URL)
+
+			quota, limited := quotas[key]
+			if !limited && f.DefaultQuota > 0 {
+				quota, limited = f.DefaultQuota, true
+			}
+
+			reason := ""
+			switch {
+			case len(allow) > 0 && !allow[key]:
+				reason = "not allowed"
+			case deny[key]:
+				reason = "denied"
+			case !f.AllowNSFW && task.Metadata["over_18"] == "true":
+				reason = "nsfw"
+			case !f.AllowQuarantined && task.Metadata["quarantined"] == "true":
+				reason = "quarantined"
+			case limited && !threads[key][thread] && len(threads[key]) >= quota:
+				reason = "quota"
+			}
+			if reason != "" {
+				dropped[reason]++
+				continue
+			}
+			if threads[key] == nil {
+				threads[key] = make(map[string]bool)
+			}
+			threads[key][thread] = true
+
+			// Record the subreddit on every sample
+			if subreddit != "" && task.Metadata["subreddit"] == "" {
+				task.Metadata = maps.Clone(task.Metadata)
+				if task.Metadata == nil {
+					task.Metadata = make(map[string]string)
+				}
+				task.Metadata["subreddit"] = subreddit
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- task:
+			}
+		}
+		log.Printf("Reddit filter kept %d subreddits, dropped: %v\n", len(threads), dropped)
+	}()
+	return out
+}
 
 type CCRecord struct {
 	URL    string `json:"url"`
@@ -27,6 +149,8 @@ type FetchLinks struct {
 	Label        string
 	QueryPattern string
 	Target       int
+	// RedditJSON points the links at the thread's JSON endpoint instead of old.reddit HTML
+	RedditJSON bool
 }
 
 func (f *FetchLinks) Stage(ctx context.Context, in chan Task) chan Task {
@@ -71,7 +195,10 @@ func (f *FetchLinks) Stage(ctx context.Context, in chan Task) chan Task {
 					default:
 						// Force old reddit for easier parsing
 						rec.URL = strings.Replace(rec.URL, "www.reddit.com", "old.reddit.com", 1)
-						out <- Task{ID: count, URL: rec.URL}
+						if f.RedditJSON {
+							rec.URL = redditJSONURL(rec.URL)
+						}
+						out <- Task{ID: SampleID("url", rec.URL), URL: rec.URL}
 						count++
 					}
 				}
@@ -90,47 +217,445 @@ func (f *FetchLinks) Stage(ctx context.Context, in chan Task) chan Task {
 	return out
 }
 
-func (e *ExtractTextReddit) Stage(ctx context.Context, in chan Task) chan Task {
-	out := make(chan Task)
+// redditJSONURL turns a thread permalink into the URL of its JSON listing
+func redditJSONURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + ".json"
+	// raw_json=1 stops Reddit from HTML-escaping the text fields
+	u.RawQuery = "raw_json=1"
+	u.Fragment = ""
+	return u.String()
+}
+
+// redditThing is the data of a post or comment in Reddit's JSON API
+type redditThing struct {
+	ID            string          `json:"id"`
+	Author        string          `json:"author"`
+	Title         string          `json:"title"`
+	Selftext      string          `json:"selftext"`
+	Body          string          `json:"body"`
+	Subreddit     string          `json:"subreddit"`
+	Permalink     string          `json:"permalink"`
+	Score         int             `json:"score"`
+	NumComments   int             `json:"num_comments"`
+	CreatedUTC    json.Number     `json:"created_utc"` // Some dumps store it as a string
+	Stickied      bool            `json:"stickied"`
+	Distinguished string          `json:"distinguished"`
+	Over18        bool            `json:"over_18"`
+	Quarantine    bool            `json:"quarantine"`
+	LinkID        string          `json:"link_id,omitempty"`   // Comments only, "t3_<post id>"
+	ParentID      string          `json:"parent_id,omitempty"` // Comments only, "t3_..." or "t1_..."
+	Replies       json.RawMessage `json:"replies,omitempty"`   // A listing, or "" without replies
+}
+
+// unescape decodes the HTML entities in the text fields. Dumps store the text
+// escaped, listings fetched with raw_json=1 don't.
+func (t *redditThing) unescape() {
+	t.Title = html.UnescapeString(t.Title)
+	t.Selftext = html.UnescapeString(t.Selftext)
+	t.Body = html.UnescapeString(t.Body)
+}
+
+// thread converts a post into a thread without comments
+func (t *redditThing) thread() *redditThread {
+	created, _ := t.CreatedUTC.Float64()
+	return &redditThread{
+		Title:       t.Title,
+		Body:        t.Selftext,
+		Author:      t.Author,
+		Subreddit:   t.Subreddit,
+		Permalink:   t.Permalink,
+		Score:       t.Score,
+		NumComments: t.NumComments,
+		Created:     int64(created),
+		Over18:      t.Over18,
+		Quarantined: t.Quarantine,
+	}
+}
+
+// comment converts a comment without its replies
+func (t *redditThing) comment() *redditComment {
+	return &redditComment{
+		ID:            t.ID,
+		Author:        t.Author,
+		Body:          t.Body,
+		Score:         t.Score,
+		Stickied:      t.Stickied,
+		Distinguished: t.Distinguished,
+	}
+}
+
+type redditListing struct {
+	Data struct {
+		Children []struct {
+			Kind string      `json:"kind"`
+			Data redditThing `json:"data"`
+		} `json:"children"`
+	} `json:"data"`
+}
+
+// parseRedditJSON reads a thread from the [post listing, comment listing] pair
+// served at <permalink>.json
+func parseRedditJSON(data []byte) (*redditThread, error) {
+	var listings []redditListing
+	if err := json.Unmarshal(data, &listings); err != nil {
+		return nil, err
+	}
+	if len(listings) < 2 || len(listings[0].Data.Children) == 0 {
+		return nil, fmt.Errorf("unexpected reddit listing shape")
+	}
+
+	thread := listings[0].Data.Children[0].Data.thread()
+
+	var walk func(listing redditListing) []*redditComment
+	walk = func(listing redditListing) []*redditComment {
+		var comments []*redditComment
+		for _, child := range listing.Data.Children {
+			// "more" stubs only point at comments that weren't loaded
+			if child.Kind != "t1" {
+				continue
+			}
+			c := child.Data
+			comment := c.comment()
+			if bytes.HasPrefix(bytes.TrimSpace(c.Replies), []byte("{")) {
+				var replies redditListing
+				if err := json.Unmarshal(c.Replies, &replies); err == nil {
+					comment.Replies = walk(replies)
+				}
+			}
+			comments = append(comments, comment)
+		}
+		return comments
+	}
+	thread.Comments = walk(listings[1])
+
+	return thread, nil
+}
+
+// redditComment is one node of a thread's comment tree
+type redditComment struct {
+	ID            string // Without the "t1_" prefix, empty when the markup has none
+	Author        string
+	Body          string
+	Score         int
+	Stickied      bool
+	Distinguished string // "moderator", "admin" or empty
+	Replies       []*redditComment
+}
+
+// redditThread is a post together with its comment tree
+type redditThread struct {
+	Title       string
+	Body        string
+	Author      string
+	Subreddit   string
+	Permalink   string
+	Score       int
+	NumComments int
+	Created     int64 // Unix seconds, zero when unknown
+	Over18      bool
+	Quarantined bool
+	Comments    []*redditComment
+}
+
+// parseOldReddit reads a thread from old.reddit.com markup
+func parseOldReddit(doc *goquery.Document) *redditThread {
+	// On old.reddit.com, the main post is in div.sitetable -> div.thing
+	post := doc.Find("div.sitetable.linklisting > div.thing").First()
+	score, _ := strconv.Atoi(post.AttrOr("data-score", "0"))
+	comments, _ := strconv.Atoi(post.AttrOr("data-comments-count", "0"))
+	created, _ := strconv.ParseInt(post.AttrOr("data-timestamp", "0"), 10, 64)
+	thread := &redditThread{
+		Title:       doc.Find("a.title").First().Text(),
+		Body:        doc.Find("div.expando div.usertext-body").First().Text(),
+		Author:      post.AttrOr("data-author", ""),
+		Subreddit:   post.AttrOr("data-subreddit", ""),
+		Permalink:   post.AttrOr("data-permalink", ""),
+		Score:       score,
+		NumComments: comments,
+		Created:     created / 1000, // data-timestamp is in milliseconds
+		Over18:      post.HasClass("over18") || post.AttrOr("data-nsfw", "") == "true",
+	}
+
+	// Gated communities show an interstitial instead of the thread
+	interstitial := strings.ToLower(doc.Find("div.interstitial, .quarantine-notice").Text())
+	if strings.Contains(interstitial, "quarantined") || doc.Find(".quarantine-notice").Length() > 0 {
+		thread.Quarantined = true
+	}
+	if strings.Contains(interstitial, "over 18") || strings.Contains(interstitial, "adult content") ||
+		doc.Find(`form[action*="over18"]`).Length() > 0 {
+		thread.Over18 = true
+	}
+
+	// Comments nest as div.thing > div.child > div.sitetable > div.thing
+	var walk func(list *goquery.Selection) []*redditComment
+	walk = func(list *goquery.Selection) []*redditComment {
+		var comments []*redditComment
+		list.ChildrenFiltered("div.thing.comment").Each(func(i int, s *goquery.Selection) {
+			entry := s.ChildrenFiltered("div.entry")
+			tagline := entry.Find("p.tagline").First()
 
+			// The exact score is in the title of the "N points" span
+			score, err := strconv.Atoi(s.AttrOr("data-score", ""))
+			if err != nil {
+				score, _ = strconv.Atoi(tagline.Find("span.score.unvoted").AttrOr("title", "0"))
+			}
+
+			distinguished := ""
+			author := tagline.Find("a.author").First()
+			switch {
+			case author.HasClass("moderator"):
+				distinguished = "moderator"
+			case author.HasClass("admin"):
+				distinguished = "admin"
+			}
+
+			comments = append(comments, &redditComment{
+				ID:            strings.TrimPrefix(s.AttrOr("data-fullname", ""), "t1_"),
+				Author:        s.AttrOr("data-author", ""),
+				Body:          entry.Find("div.usertext-body").First().Text(),
+				Score:         score,
+				Stickied:      s.HasClass("stickied"),
+				Distinguished: distinguished,
+				Replies:       walk(s.ChildrenFiltered("div.child").ChildrenFiltered("div.sitetable")),
+			})
+		})
+		return comments
+	}
+	thread.Comments = walk(doc.Find("div.commentarea > div.sitetable"))
+
+	return thread
+}
+
+// parseShreddit reads a thread from the web-component markup of www.reddit.com,
+// where the post is a <shreddit-post> and comments are nested <shreddit-comment>s
+func parseShreddit(doc *goquery.Document) *redditThread {
+	post := doc.Find("shreddit-post").First()
+
+	title := post.AttrOr("post-title", "")
+	if title == "" {
+		title = post.Find(`[slot="title"]`).First().Text()
+	}
+	score, _ := strconv.Atoi(post.AttrOr("score", "0"))
+	comments, _ := strconv.Atoi(post.AttrOr("comment-count", "0"))
+	thread := &redditThread{
+		Title:       title,
+		Body:        post.Find(`[slot="text-body"]`).First().Text(),
+		Author:      post.AttrOr("author", ""),
+		Subreddit:   strings.TrimPrefix(post.AttrOr("subreddit-prefixed-name", ""), "r/"),
+		Permalink:   post.AttrOr("permalink", ""),
+		Score:       score,
+		NumComments: comments,
+		Over18:      post.Is("[nsfw], [is-nsfw]"),
+		Quarantined: post.Is("[quarantined]"),
+	}
+	if created, err := time.Parse("2006-01-02T15:04:05.999999-0700", post.AttrOr("created-timestamp", "")); err == nil {
+		thread.Created = created.Unix()
+	}
+
+	var build func(s *goquery.Selection) *redditComment
+	build = func(s *goquery.Selection) *redditComment {
+		score, _ := strconv.Atoi(s.AttrOr("score", "0"))
+		c := &redditComment{
+			ID:            strings.TrimPrefix(s.AttrOr("thingid", ""), "t1_"),
+			Author:        s.AttrOr("author", ""),
+			Body:          s.ChildrenFiltered(`[slot="comment"]`).First().Text(),
+			Score:         score,
+			Stickied:      s.Is("[stickied], [is-stickied]"),
+			Distinguished: s.AttrOr("distinguished", ""),
+		}
+		// Replies are the comments whose closest comment ancestor is s
+		s.Find("shreddit-comment").Each(func(i int, child *goquery.Selection) {
+			if child.Parent().Closest("shreddit-comment").IsSelection(s) {
+				c.Replies = append(c.Replies, build(child))
+			}
+		})
+		return c
+	}
+	doc.Find("shreddit-comment").Each(func(i int, s *goquery.Selection) {
+		if s.ParentsFiltered("shreddit-comment").Length() == 0 {
+			thread.Comments = append(thread.Comments, build(s))
+		}
+	})
+
+	return thread
+}
+
+// parseReddit reads a thread from a JSON listing, shreddit or old.reddit HTML
+func parseReddit(content string) (*redditThread, error) {
+	if strings.HasPrefix(strings.TrimSpace(content), "[") {
+		return parseRedditJSON([]byte(content))
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if doc.Find("shreddit-post").Length() > 0 {
+		return parseShreddit(doc), nil
+	}
+	return parseOldReddit(doc), nil
+}
+
+// removedText reports whether a post or comment body was deleted or removed
+func removedText(body string) bool {
+	body = strings.TrimSpace(body)
+	return body == "[removed]" || body == "[deleted]"
+}
+
+// threadSamples turns a thread into dialogue samples: the post paired with its best
+// comment, or in multi-turn mode one reply chain per top-level comment. The returned
+// tasks only carry Content and Metadata.
+func (e *ExtractTextReddit) threadSamples(thread *redditThread) []Task {
 	cleanText := func(input string) string {
 		s := reSpace.ReplaceAllString(input, " ")
 		return strings.TrimSpace(reNewlines.ReplaceAllString(s, "\n\n"))
 	}
 
-	go func() {
-		defer close(out)
-		for task := range in {
-			// TODO : Add standard checks/doc creation here
+	minLength := e.MinLength
+	if minLength == 0 {
+		minLength = 10
+	}
+
+	// eligible rejects bots, mod notes, removed comments and low scores
+	eligible := func(c *redditComment) bool {
+		if c.Author == "AutoModerator" || c.Author == "[deleted]" || c.Stickied || c.Distinguished != "" {
+			return false
+		}
+		text := cleanText(c.Body)
+		if removedText(text) || len(text) <= minLength {
+			return false
+		}
+		return c.Score >= e.MinScore
+	}
+
+	// ranked returns the eligible comments, best score first
+	ranked := func(comments []*redditComment) []*redditComment {
+		var result []*redditComment
+		for _, c := range comments {
+			if eligible(c) {
+				result = append(result, c)
+			}
+		}
+		slices.SortStableFunc(result, func(a, b *redditComment) int {
+			return cmp.Compare(b.Score, a.Score)
+		})
+		return result
+	}
+
+	metadata := map[string]string{}
+	if thread.Subreddit != "" {
+		metadata["subreddit"] = thread.Subreddit
+	}
+	if thread.Permalink != "" {
+		metadata["permalink"] = thread.Permalink
+	}
+	if thread.Created != 0 {
+		metadata["created_utc"] = strconv.FormatInt(thread.Created, 10)
+	}
+	metadata["over_18"] = strconv.FormatBool(thread.Over18)
+	metadata["quarantined"] = strconv.FormatBool(thread.Quarantined)
+	metadata["post_score"] = strconv.Itoa(thread.Score)
+	metadata["num_comments"] = strconv.Itoa(thread.NumComments)
+
+	// sample records the comment that answers the post
+	sample := func(turns []Turn, top *redditComment) Task {
+		m := maps.Clone(metadata)
+		m["score"] = strconv.Itoa(top.Score)
+		if top.ID != "" {
+			m["comment_id"] = top.ID
+		}
+		return Task{Content: formatDialogue(turns), Turns: turns, Metadata: m}
+	}
 
-			doc, _ := goquery.NewDocumentFromReader(bytes.NewReader([]byte(task.Content)))
+	// Posts taken down by their author or the moderators are skipped
+	if removedText(thread.Body) {
+		return nil
+	}
+	question := cleanText(strings.TrimSpace(thread.Title + "\n" + thread.Body))
+	if len(question) <= minLength {
+		return nil
+	}
 
-			// 1. Extract Question (Title + Selftext)
-			// On old.reddit.com, the main post is in div.sitetable -> div.thing
-			title := doc.Find("a.title").First().Text()
-			body := doc.Find("div.expando div.usertext-body").First().Text()
+	answers := ranked(thread.Comments)
+	if len(answers) == 0 {
+		return nil
+	}
+	if !e.MultiTurn {
+		turns := []Turn{{Role: "user", Text: question}, {Role: "bot", Text: cleanText(answers[0].Body)}}
+		return []Task{sample(turns, answers[0])}
+	}
 
-			questionText := strings.TrimSpace(title + "\n" + body)
+	var result []Task
+	for _, top := range answers {
+		// The OP always speaks as the user
+		if thread.Author != "" && top.Author == thread.Author {
+			continue
+		}
+		turns := []Turn{{Role: "user", Text: question}, {Role: "bot", Text: cleanText(top.Body)}}
+		speaker := map[string]string{"user": thread.Author, "bot": top.Author}
+		role := "user"
+
+		node := top
+		for depth := 2; thread.Author != "" && top.Author != ""; depth++ {
+			if e.MaxDepth > 0 && depth > e.MaxDepth {
+				break
+			}
+			// Only the two speakers take turns
+			var next *redditComment
+			for _, reply := range ranked(node.Replies) {
+				if reply.Author == speaker[role] {
+					next = reply
+					break
+				}
+			}
+			if next == nil {
+				break
+			}
+			turns = append(turns, Turn{Role: role, Text: cleanText(next.Body)})
+			node = next
+			if role == "bot" {
+				role = "user"
+			} else {
+				role = "bot"
+			}
+		}
 
-			// 2. Extract Top Answer
-			// We only want the top comment to act as the "bot"
-			// '.commentarea > .sitetable > .thing' selects top-level comments only
-			topComment := doc.Find("div.commentarea > div.sitetable > div.thing").First()
-			answerText := topComment.Find("div.usertext-body").First().Text()
+		// Dialogues end on a bot turn
+		if turns[len(turns)-1].Role == "user" {
+			turns = turns[:len(turns)-1]
+		}
+		if len(turns) >= 2 {
+			result = append(result, sample(turns, top))
+		}
+	}
+	return result
+}
 
-			// Basic validation to ensure we have content
-			if len(questionText) > 10 && len(answerText) > 10 {
-				formatted := fmt.Sprintf("<user>: %s\n<bot>: %s\n<eos>\n",
-					cleanText(questionText),
-					cleanText(answerText))
+func (e *ExtractTextReddit) Stage(ctx context.Context, in chan Task) chan Task {
+	out := make(chan Task)
+	go func() {
+		defer close(out)
+		for task := range in {
+			thread, err := parseReddit(task.Content)
+			if err != nil {
+				log.Println("Parsing reddit thread failed for task ID=", task.ID, " with error=", err)
+				continue
+			}
 
+			for i, sample := range e.threadSamples(thread) {
+				// Keyed by the comment that answers the post, the index is a fallback for markup without ids
+				sample.ID = SampleID("reddit", cmp.Or(thread.Permalink, task.URL), cmp.Or(sample.Metadata["comment_id"], strconv.Itoa(i)))
+				sample.URL = task.URL
 				select {
 				case <-ctx.Done():
 					return
-				case out <- Task{ID: task.ID, Content: formatted}:
+				case out <- sample:
 				}
 			}
 		}
 	}()
 	return out
-}
\ No newline at end of file
+}
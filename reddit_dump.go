@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// StreamRedditDumps: Reads zstd-compressed NDJSON dumps of Reddit submissions (RS_*.zst)
+// and comments (RC_*.zst) from Directory, joins comments to their submissions and
+// emits the threads in the same Q&A format as ExtractTextReddit, without any scraping.
+type StreamRedditDumps struct {
+	Directory string
+	// Partitions is the number of on-disk partitions used for the join. Zero sizes
+	// it from the dumps, PartitionBytes of compressed input per partition. Only one
+	// partition is held in memory at a time.
+	Partitions     int
+	PartitionBytes int64 // 0 = 16 MiB
+	// TempDir holds the partition files (empty = the system temp directory)
+	TempDir string
+	// Extract holds the dialogue options, as for live pages
+	Extract ExtractTextReddit
+}
+
+// forEachDumpLine streams every line of a zstd-compressed NDJSON file
+func forEachDumpLine(filename string, fn func(line []byte) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The community dumps are compressed with a long window
+	decoder, err := zstd.NewReader(file, zstd.WithDecoderMaxWindow(1<<31))
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	r := bufio.NewReaderSize(decoder, 1<<20)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *StreamRedditDumps) Stage(ctx context.Context, in chan Task) chan Task {
+	out := make(chan Task)
+	go func() {
+		defer close(out)
+
+		submissionFiles, _ := filepath.Glob(filepath.Join(s.Directory, "RS_*.zst"))
+		commentFiles, _ := filepath.Glob(filepath.Join(s.Directory, "RC_*.zst"))
+		if len(submissionFiles) == 0 {
+			log.Println("No RS_*.zst files found in", s.Directory)
+			return
+		}
+
+		partitions := s.Partitions
+		if partitions == 0 {
+			var size int64
+			for _, file := range slices.Concat(submissionFiles, commentFiles) {
+				if info, err := os.Stat(file); err == nil {
+					size += info.Size()
+				}
+			}
+			// Posts and comments are the only spools, and one join runs at a time
+			partitions = partitionCount(size, cmp.Or(s.PartitionBytes, 16<<20), maxSpoolFiles/2)
+			log.Printf("Joining %d MiB of dumps in %d partitions.\n", size>>20, partitions)
+		}
+
+		tmp, err := os.MkdirTemp(s.TempDir, "reddit-dump-")
+		if err != nil {
+			log.Println("Error creating temp dir:", err)
+			return
+		}
+		defer os.RemoveAll(tmp)
+
+		posts, err := newPartitionSpool(tmp, "posts", partitions)
+		if err != nil {
+			log.Println("Error creating spool:", err)
+			return
+		}
+		defer posts.Close()
+		comments, err := newPartitionSpool(tmp, "comments", partitions)
+		if err != nil {
+			log.Println("Error creating spool:", err)
+			return
+		}
+		defer comments.Close()
+
+		// 1. Scatter submissions by id and comments by the id of their submission.
+		// Only the fields we use are kept, which shrinks the dumps considerably.
+		spool := func(files []string, target *partitionSpool, key func(t *redditThing) string) bool {
+			for _, file := range files {
+				log.Println("Spooling dump:", file)
+				lines, skipped := 0, 0
+				err := forEachDumpLine(file, func(line []byte) error {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					default:
+					}
+					var thing redditThing
+					if err := json.Unmarshal(line, &thing); err != nil {
+						skipped++
+						return nil
+					}
+					thing.unescape()
+					k := key(&thing)
+					if k == "" {
+						skipped++
+						return nil
+					}
+					record, err := json.Marshal(&thing)
+					if err != nil {
+						return err
+					}
+					lines++
+					return target.Add(k, record)
+				})
+				if err != nil {
+					log.Printf("Error reading %s: %v", file, err)
+					return false
+				}
+				log.Printf("Spooled %s: %d records, %d skipped.\n", filepath.Base(file), lines, skipped)
+			}
+			return true
+		}
+
+		if !spool(submissionFiles, posts, func(t *redditThing) string {
+			if t.Title == "" || removedText(t.Selftext) {
+				return ""
+			}
+			return t.ID
+		}) {
+			return
+		}
+		if !spool(commentFiles, comments, func(t *redditThing) string {
+			t.Replies = nil
+			return strings.TrimPrefix(t.LinkID, "t3_")
+		}) {
+			return
+		}
+
+		// 2. Join one partition at a time
+		count := 0
+		for i := 0; i < partitions; i++ {
+			threads := make(map[string]*redditThread)
+			var order []string
+			err := posts.Each(i, func(record []byte) error {
+				var t redditThing
+				if err := json.Unmarshal(record, &t); err != nil {
+					return err
+				}
+				if _, exists := threads[t.ID]; !exists {
+					order = append(order, t.ID)
+				}
+				threads[t.ID] = t.thread()
+				return nil
+			})
+			if err != nil {
+				log.Println("Error reading posts partition:", err)
+				return
+			}
+
+			type node struct {
+				thing   redditThing
+				comment *redditComment
+			}
+			var nodes []*node
+			byID := make(map[string]*node)
+			err = comments.Each(i, func(record []byte) error {
+				var t redditThing
+				if err := json.Unmarshal(record, &t); err != nil {
+					return err
+				}
+				if threads[strings.TrimPrefix(t.LinkID, "t3_")] == nil {
+					return nil
+				}
+				n := &node{thing: t, comment: t.comment()}
+				nodes = append(nodes, n)
+				byID[t.ID] = n
+				return nil
+			})
+			if err != nil {
+				log.Println("Error reading comments partition:", err)
+				return
+			}
+
+			// Oldest comments first, so the trees don't depend on dump order
+			slices.SortStableFunc(nodes, func(a, b *node) int {
+				x, _ := a.thing.CreatedUTC.Float64()
+				y, _ := b.thing.CreatedUTC.Float64()
+				return cmp.Compare(x, y)
+			})
+			for _, n := range nodes {
+				kind, parent, _ := strings.Cut(n.thing.ParentID, "_")
+				switch kind {
+				case "t3":
+					if thread := threads[parent]; thread != nil {
+						thread.Comments = append(thread.Comments, n.comment)
+					}
+				case "t1":
+					if p := byID[parent]; p != nil {
+						p.comment.Replies = append(p.comment.Replies, n.comment)
+					}
+				}
+			}
+
+			slices.Sort(order)
+			for _, postID := range order {
+				thread := threads[postID]
+				for j, sample := range s.Extract.threadSamples(thread) {
+					sample.ID = SampleID("reddit", cmp.Or(thread.Permalink, postID), cmp.Or(sample.Metadata["comment_id"], strconv.Itoa(j)))
+					if thread.Permalink != "" {
+						sample.URL = "https://www.reddit.com" + thread.Permalink
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case out <- sample:
+						count++
+					}
+				}
+			}
+		}
+		log.Printf("Finished reddit dumps. Extracted %d samples.\n", count)
+	}()
+	return out
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const redditFixtureURL = "https://www.reddit.com/r/golang/comments/1abc23/how_do_i_close_a_channel_safely/"
+
+// commentTree renders a comment tree as "author(score)[replies...]"
+func commentTree(comments []*redditComment) string {
+	var parts []string
+	for _, c := range comments {
+		part := fmt.Sprintf("%s(%d)", c.Author, c.Score)
+		if len(c.Replies) > 0 {
+			part += "[" + commentTree(c.Replies) + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestRedditJSONURL(t *testing.T) {
+	tests := []struct {
+		link, want string
+	}{
+		{redditFixtureURL, "https://www.reddit.com/r/golang/comments/1abc23/how_do_i_close_a_channel_safely.json?raw_json=1"},
+		{"https://old.reddit.com/r/golang/comments/1abc23/title", "https://old.reddit.com/r/golang/comments/1abc23/title.json?raw_json=1"},
+		{"https://www.reddit.com/r/golang/comments/1abc23/title/?utm_source=share&context=3#comments", "https://www.reddit.com/r/golang/comments/1abc23/title.json?raw_json=1"},
+	}
+	for _, tt := range tests {
+		if got := redditJSONURL(tt.link); got != tt.want {
+			t.Errorf("redditJSONURL(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestParseRedditJSON(t *testing.T) {
+	thread, err := parseReddit(readFixture(t, "reddit", "how_do_i_close_a_channel_safely.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if thread.Title != "How do I close a channel safely?" || thread.Author != "gopher_op" || thread.Subreddit != "golang" {
+		t.Errorf("thread = %q by %q in %q", thread.Title, thread.Author, thread.Subreddit)
+	}
+	// raw_json=1 text is not unescaped a second time
+	if !strings.Contains(thread.Body, "one channel & a single reader") {
+		t.Errorf("body = %q", thread.Body)
+	}
+	if thread.Created != 1700000000 || thread.Score != 128 || thread.NumComments != 9 {
+		t.Errorf("created = %d, score = %d, num_comments = %d", thread.Created, thread.Score, thread.NumComments)
+	}
+
+	if id := thread.Comments[1].ID; id != "k9a1" {
+		t.Errorf("comment id = %q, want k9a1", id)
+	}
+	// "more" stubs are dropped, replies: "" leaves no replies
+	want := "AutoModerator(1) alice_gc(42)[gopher_op(5)[alice_gc(8)] bob_third(10)] [deleted](3) carol_dev(7)"
+	if got := commentTree(thread.Comments); got != want {
+		t.Errorf("comment tree = %s, want %s", got, want)
+	}
+	if automod := thread.Comments[0]; !automod.Stickied || automod.Distinguished != "moderator" {
+		t.Errorf("AutoModerator comment: stickied = %v, distinguished = %q", automod.Stickied, automod.Distinguished)
+	}
+	if body := thread.Comments[1].Body; !strings.Contains(body, "write &amp; for an ampersand") {
+		t.Errorf("comment body = %q", body)
+	}
+}
+
+func TestExtractTextRedditJSON(t *testing.T) {
+	question := "How do I close a channel safely?\nI have several goroutines sending on one channel & a single reader. Who should close it?"
+	alice := "Only the sender closes a channel. In HTML you'd write &amp; for an ampersand, here you just write v, ok := <-ch."
+	tests := []struct {
+		name      string
+		extract   ExtractTextReddit
+		dialogues [][]Turn
+		comments  []string // Ids of the answering comments
+		scores    []string
+	}{
+		{
+			name:      "single",
+			extract:   ExtractTextReddit{},
+			dialogues: [][]Turn{{{"user", question}, {"bot", alice}}},
+			comments:  []string{"k9a1"},
+			scores:    []string{"42"},
+		},
+		{
+			name:    "multi-turn",
+			extract: ExtractTextReddit{MultiTurn: true},
+			dialogues: [][]Turn{
+				{
+					{"user", question},
+					{"bot", alice},
+					{"user", "Thanks, but what if there are several senders and none of them knows it is the last one?"},
+					{"bot", "Then count the senders with a sync.WaitGroup and close the channel from one extra goroutine once Wait returns."},
+				},
+				{{"user", question}, {"bot", "Closing a channel twice panics, so guard the close with a sync.Once."}},
+			},
+			comments: []string{"k9a1", "k9a6"},
+			scores:   []string{"42", "7"},
+		},
+		{
+			name:      "max depth",
+			extract:   ExtractTextReddit{MultiTurn: true, MaxDepth: 2},
+			dialogues: [][]Turn{{{"user", question}, {"bot", alice}}, {{"user", question}, {"bot", "Closing a channel twice panics, so guard the close with a sync.Once."}}},
+			comments:  []string{"k9a1", "k9a6"},
+			scores:    []string{"42", "7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := Task{URL: redditFixtureURL, Content: readFixture(t, "reddit", "how_do_i_close_a_channel_safely.json")}
+			out := runStage(t, &tt.extract, task)
+			if len(out) != len(tt.dialogues) {
+				t.Fatalf("got %d samples, want %d", len(out), len(tt.dialogues))
+			}
+			for i, sample := range out {
+				if !slices.Equal(sample.Turns, tt.dialogues[i]) {
+					t.Errorf("sample %d turns = %q, want %q", i, sample.Turns, tt.dialogues[i])
+				}
+				if sample.Content != formatDialogue(tt.dialogues[i]) {
+					t.Errorf("sample %d content = %q", i, sample.Content)
+				}
+				if sample.URL != redditFixtureURL {
+					t.Errorf("sample %d url = %q", i, sample.URL)
+				}
+				// Keyed by the answering comment, not the sample's position
+				permalink := "/r/golang/comments/1abc23/how_do_i_close_a_channel_safely/"
+				if want := SampleID("reddit", permalink, tt.comments[i]); sample.ID != want {
+					t.Errorf("sample %d id = %q, want %q", i, sample.ID, want)
+				}
+
+				want := map[string]string{
+					"subreddit":    "golang",
+					"permalink":    "/r/golang/comments/1abc23/how_do_i_close_a_channel_safely/",
+					"created_utc":  "1700000000",
+					"over_18":      "false",
+					"quarantined":  "false",
+					"post_score":   "128",
+					"num_comments": "9",
+					"score":        tt.scores[i],
+					"comment_id":   tt.comments[i],
+				}
+				if !maps.Equal(sample.Metadata, want) {
+					t.Errorf("sample %d metadata = %v, want %v", i, sample.Metadata, want)
+				}
+			}
+		})
+	}
+}
+
+// writeDump writes NDJSON lines to a zstd-compressed dump file
+func writeDump(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := zstd.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		w.Write([]byte(line + "\n"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedditRemovedPosts(t *testing.T) {
+	content := strings.Replace(readFixture(t, "reddit", "how_do_i_close_a_channel_safely.json"),
+		"I have several goroutines sending on one channel & a single reader. Who should close it?", "[removed]", 1)
+	if out := runStage(t, &ExtractTextReddit{}, Task{URL: redditFixtureURL, Content: content}); len(out) != 0 {
+		t.Errorf("removed post gave %d samples", len(out))
+	}
+
+	dir := t.TempDir()
+	writeDump(t, filepath.Join(dir, "RS_2023-11.zst"),
+		`{"id":"p1","author":"op1","title":"Why does my goroutine leak?","selftext":"It never returns &amp; memory grows.","subreddit":"golang","permalink":"/r/golang/comments/p1/leak/"}`,
+		`{"id":"p2","author":"op2","title":"Which editor should I use for Go?","selftext":"[removed]","subreddit":"golang","permalink":"/r/golang/comments/p2/editor/"}`,
+		`{"id":"p3","author":"op3","title":"Is this a question about deleted posts?","selftext":"[deleted]","subreddit":"golang","permalink":"/r/golang/comments/p3/deleted/"}`,
+	)
+	writeDump(t, filepath.Join(dir, "RC_2023-11.zst"),
+		`{"id":"c1","author":"helper","body":"Your goroutine blocks on a send nobody receives &gt; add a done channel.","score":4,"link_id":"t3_p1","parent_id":"t3_p1","created_utc":"1700000100"}`,
+		`{"id":"c2","author":"helper","body":"Any editor with gopls support works well enough.","score":4,"link_id":"t3_p2","parent_id":"t3_p2","created_utc":"1700000100"}`,
+		`{"id":"c3","author":"helper","body":"Deleted posts shouldn't turn into samples at all.","score":4,"link_id":"t3_p3","parent_id":"t3_p3","created_utc":"1700000100"}`,
+	)
+
+	out := runStage(t, &StreamRedditDumps{Directory: dir, TempDir: t.TempDir()})
+	if len(out) != 1 {
+		t.Fatalf("got %d samples, want 1", len(out))
+	}
+	// Dumps store the text HTML-escaped
+	want := []Turn{
+		{"user", "Why does my goroutine leak?\nIt never returns & memory grows."},
+		{"bot", "Your goroutine blocks on a send nobody receives > add a done channel."},
+	}
+	if !slices.Equal(out[0].Turns, want) {
+		t.Errorf("turns = %q, want %q", out[0].Turns, want)
+	}
+	if id := SampleID("reddit", "/r/golang/comments/p1/leak/", "c1"); out[0].ID != id {
+		t.Errorf("id = %q, want %q", out[0].ID, id)
+	}
+}
+
+func TestFilterRedditQuota(t *testing.T) {
+	sample := func(subreddit, permalink string) Task {
+		return Task{Metadata: map[string]string{"subreddit": subreddit, "permalink": permalink}}
+	}
+	out := runStage(t, &FilterReddit{Quotas: map[string]int{"golang": 2}, DefaultQuota: 1},
+		sample("golang", "/r/golang/comments/a/"),
+		sample("golang", "/r/golang/comments/a/"),
+		sample("golang", "/r/golang/comments/b/"),
+		sample("golang", "/r/golang/comments/c/"),
+		sample("golang", "/r/golang/comments/a/"),
+		sample("rust", "/r/rust/comments/d/"),
+		sample("rust", "/r/rust/comments/e/"),
+	)
+
+	var got []string
+	for _, task := range out {
+		got = append(got, task.Metadata["permalink"])
+	}
+	// The quota counts threads, every sample of a thread that made it is kept
+	want := []string{"/r/golang/comments/a/", "/r/golang/comments/a/", "/r/golang/comments/b/", "/r/golang/comments/a/", "/r/rust/comments/d/"}
+	if !slices.Equal(got, want) {
+		t.Errorf("kept %q, want %q", got, want)
+	}
+}
+
+// describeThread renders a thread with its whitespace collapsed, so captures of
+// the same thread in different markups compare equal
+func describeThread(thread *redditThread) string {
+	squash := func(s string) string { return strings.Join(strings.Fields(s), " ") }
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\nby %s in r/%s at %s\nscore=%d comments=%d created=%d nsfw=%v quarantined=%v\n",
+		squash(thread.Title), squash(thread.Body), thread.Author, thread.Subreddit, thread.Permalink,
+		thread.Score, thread.NumComments, thread.Created, thread.Over18, thread.Quarantined)
+	var walk func(comments []*redditComment, depth int)
+	walk = func(comments []*redditComment, depth int) {
+		for _, c := range comments {
+			fmt.Fprintf(&b, "%s%s %s score=%d stickied=%v distinguished=%q: %s\n",
+				strings.Repeat("  ", depth), c.ID, c.Author, c.Score, c.Stickied, c.Distinguished, squash(c.Body))
+			walk(c.Replies, depth+1)
+		}
+	}
+	walk(thread.Comments, 0)
+	return b.String()
+}
+
+func TestParseRedditMarkups(t *testing.T) {
+	want, err := parseReddit(readFixture(t, "reddit", "how_do_i_close_a_channel_safely.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fixture := range []string{"shreddit.html", "old-reddit.html"} {
+		t.Run(fixture, func(t *testing.T) {
+			thread, err := parseReddit(readFixture(t, "reddit", fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// created-timestamp and data-timestamp both come out as Unix seconds
+			if thread.Created != 1700000000 {
+				t.Errorf("created = %d, want 1700000000", thread.Created)
+			}
+			if got, want := describeThread(thread), describeThread(want); got != want {
+				t.Errorf("thread differs from the JSON listing:\n%s\nwant:\n%s", got, want)
+			}
+
+			out := runStage(t, &ExtractTextReddit{MultiTurn: true}, Task{URL: redditFixtureURL, Content: readFixture(t, "reddit", fixture)})
+			if len(out) != 2 || len(out[0].Turns) != 4 {
+				t.Errorf("got %d samples: %q", len(out), out)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Sharding configures how a writer splits and compresses its output. The zero value
+// writes a single uncompressed file. With MaxBytes or MaxRecords set, the output is
+// split into dataset_wiki-00000-of-00003.txt style shards; records are never split
+// across shards, so a shard can overshoot MaxBytes by one record.
+type Sharding struct {
+	MaxBytes    int64  // Start a new shard once this many bytes are written, before compression (0 = no limit)
+	MaxRecords  int    // Start a new shard after this many records (0 = no limit)
+	Compression string // "gzip", "zstd" or empty for none
+}
+
+// shardManifest lists the shards of a run, written next to them as <name>.<ext>.manifest.json
+type shardManifest struct {
+	Records     int         `json:"records"`
+	Compression string      `json:"compression,omitempty"`
+	Shards      []shardInfo `json:"shards"`
+}
+
+type shardInfo struct {
+	File    string `json:"file"` // Relative to the manifest
+	Records int    `json:"records"`
+	Bytes   int64  `json:"bytes"` // On disk
+	SHA256  string `json:"sha256"`
+}
+
+// manifestPath names the manifest of a writer's output, keeping the format's
+// extension: dataset_wiki.txt -> dataset_wiki.txt.manifest.json
+func manifestPath(path string) string {
+	return path + ".manifest.json"
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// shardWriter writes records to rotating, optionally compressed shards. Shards are
+// written under temporary names and renamed by Close, once their number is known.
+type shardWriter struct {
+	Sharding
+	path   string
+	shards []shardInfo
+
+	// The shard being written
+	file    *os.File
+	sum     hash.Hash
+	onDisk  *countingWriter
+	comp    io.WriteCloser // nil when uncompressed
+	w       *bufio.Writer
+	size    int64
+	records int
+}
+
+func newShardWriter(path string, sharding Sharding) (*shardWriter, error) {
+	switch sharding.Compression {
+	case "", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("unknown compression %q", sharding.Compression)
+	}
+	return &shardWriter{Sharding: sharding, path: path}, nil
+}
+
+// open starts the next shard
+func (s *shardWriter) open() error {
+	file, err := os.Create(fmt.Sprintf("%s.%05d.tmp", s.path, len(s.shards)))
+	if err != nil {
+		return err
+	}
+	s.file, s.sum, s.onDisk = file, sha256.New(), &countingWriter{}
+	s.size, s.records, s.comp = 0, 0, nil
+
+	var w io.Writer = io.MultiWriter(file, s.sum, s.onDisk)
+	switch s.Compression {
+	case "gzip":
+		s.comp = gzip.NewWriter(w)
+	case "zstd":
+		if s.comp, err = zstd.NewWriter(w); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if s.comp != nil {
+		w = s.comp
+	}
+	s.w = bufio.NewWriterSize(w, 1<<16)
+	return nil
+}
+
+// finish completes the current shard and records it
+func (s *shardWriter) finish() error {
+	err := s.w.Flush()
+	if s.comp != nil {
+		if cerr := s.comp.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.shards = append(s.shards, shardInfo{
+		File:    s.file.Name(),
+		Records: s.records,
+		Bytes:   s.onDisk.n,
+		SHA256:  hex.EncodeToString(s.sum.Sum(nil)),
+	})
+	s.file = nil
+	return err
+}
+
+// full reports whether the current shard has reached MaxRecords or MaxBytes
+func (s *shardWriter) full() bool {
+	return s.file != nil && ((s.MaxRecords > 0 && s.records >= s.MaxRecords) || (s.MaxBytes > 0 && s.size >= s.MaxBytes))
+}
+
+// Write appends one record, starting a new shard first when the current one is full
+func (s *shardWriter) Write(record []byte) error {
+	if s.full() {
+		if err := s.finish(); err != nil {
+			return err
+		}
+	}
+	n, err := s.raw().Write(record)
+	s.count(int64(n))
+	return err
+}
+
+// raw writes into the current shard, opening it first, without counting records.
+// Formats that frame their own records (Parquet) write through it, report every
+// record with count and end a file with finish once full says so.
+func (s *shardWriter) raw() io.Writer {
+	return rawShard{s}
+}
+
+type rawShard struct {
+	s *shardWriter
+}
+
+func (r rawShard) Write(p []byte) (int, error) {
+	if r.s.file == nil {
+		if err := r.s.open(); err != nil {
+			return 0, err
+		}
+	}
+	return r.s.w.Write(p)
+}
+
+// count records one record of n bytes, before compression
+func (s *shardWriter) count(n int64) {
+	s.size += n
+	s.records++
+}
+
+// reShardName matches the names shardName gives to sharded output
+func (s *shardWriter) reShardName() *regexp.Regexp {
+	ext := filepath.Ext(s.path)
+	stem := filepath.Base(strings.TrimSuffix(s.path, ext))
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(stem) + `-\d{5}-of-\d{5}` + regexp.QuoteMeta(ext) + `(\.gz|\.zst)?$`)
+}
+
+// shardName is the final name of shard i of n
+func (s *shardWriter) shardName(i, n int) string {
+	name := s.path
+	if s.MaxBytes > 0 || s.MaxRecords > 0 {
+		ext := filepath.Ext(s.path)
+		name = fmt.Sprintf("%s-%05d-of-%05d%s", strings.TrimSuffix(s.path, ext), i, n, ext)
+	}
+	switch s.Compression {
+	case "gzip":
+		name += ".gz"
+	case "zstd":
+		name += ".zst"
+	}
+	return name
+}
+
+// Close completes the last shard, renames the shards to their final names and
+// writes the manifest. A run without records still leaves one empty shard.
+func (s *shardWriter) Close() error {
+	if s.file == nil && len(s.shards) == 0 {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.file != nil {
+		if err := s.finish(); err != nil {
+			return err
+		}
+	}
+
+	// Shards left by an earlier run would look like part of this one
+	entries, err := os.ReadDir(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	stale := s.reShardName()
+	for _, entry := range entries {
+		if stale.MatchString(entry.Name()) {
+			if err := os.Remove(filepath.Join(filepath.Dir(s.path), entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	manifest := shardManifest{Compression: s.Compression, Shards: s.shards}
+	for i := range s.shards {
+		final := s.shardName(i, len(s.shards))
+		if err := os.Rename(s.shards[i].File, final); err != nil {
+			return err
+		}
+		s.shards[i].File = filepath.Base(final)
+		manifest.Records += s.shards[i].Records
+	}
+
+	data, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifestPath(s.path), append(data, '\n'), 0o644)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readManifest loads the manifest written next to path
+func readManifest(t *testing.T, path string) shardManifest {
+	t.Helper()
+	data, err := os.ReadFile(path + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest shardManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func shardFiles(manifest shardManifest) []string {
+	var files []string
+	for _, shard := range manifest.Shards {
+		files = append(files, shard.File)
+	}
+	return files
+}
+
+func TestShardWriterRemovesStaleShards(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dataset_wiki.txt")
+	for _, name := range []string{"dataset_wiki-00000-of-00005.txt", "dataset_wiki-00004-of-00005.txt.gz", "dataset_wiki-notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("old\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer, err := newShardWriter(path, Sharding{MaxRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := writer.Write([]byte(strconv.Itoa(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{"dataset_wiki-00000-of-00002.txt", "dataset_wiki-00001-of-00002.txt", "dataset_wiki-notes.txt", "dataset_wiki.txt.manifest.json"}
+	if !slices.Equal(names, want) {
+		t.Errorf("files = %q, want %q", names, want)
+	}
+}
+
+func TestWriteParquetSharding(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dataset_wiki.parquet")
+
+	var tasks []Task
+	for i := 0; i < 25; i++ {
+		key := strconv.Itoa(i)
+		tasks = append(tasks, Task{ID: SampleID("wiki", key), URL: "https://example.org/" + key, Content: "article " + key})
+	}
+	out := runStage(t, &WriteParquet{Filepath: path, RowGroupSize: 4, Sharding: Sharding{MaxRecords: 10}}, tasks...)
+	if len(out) != len(tasks) {
+		t.Fatalf("passed on %d tasks, want %d", len(out), len(tasks))
+	}
+
+	manifest := readManifest(t, path)
+	want := []string{"dataset_wiki-00000-of-00003.parquet", "dataset_wiki-00001-of-00003.parquet", "dataset_wiki-00002-of-00003.parquet"}
+	if files := shardFiles(manifest); !slices.Equal(files, want) || manifest.Records != 25 {
+		t.Fatalf("manifest lists %q with %d records", files, manifest.Records)
+	}
+
+	// Every shard is a complete Parquet file
+	var ids []string
+	for _, shard := range manifest.Shards {
+		rows, err := parquet.ReadFile[parquetRow](filepath.Join(dir, shard.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != shard.Records {
+			t.Errorf("%s has %d rows, manifest says %d", shard.File, len(rows), shard.Records)
+		}
+		for _, row := range rows {
+			ids = append(ids, row.ID)
+		}
+	}
+	for i, task := range tasks {
+		if i >= len(ids) || ids[i] != task.ID {
+			t.Fatalf("row %d has the wrong id", i)
+		}
+	}
+
+	// Parquet compresses columns, a compressed shard is rejected
+	empty := filepath.Join(dir, "rejected.parquet")
+	runStage(t, &WriteParquet{Filepath: empty, Sharding: Sharding{Compression: "gzip"}}, tasks[0])
+	if _, err := os.Stat(empty + ".manifest.json"); !os.IsNotExist(err) {
+		t.Errorf("compressed Parquet shards were written: %v", err)
+	}
+}
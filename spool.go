@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// partitionSpool scatters records over a fixed number of temporary files by the hash
+// of a join key. Records sharing a key always land in the same partition, so a join
+// over data larger than memory can be done one partition at a time.
+type partitionSpool struct {
+	files   []*os.File
+	writers []*bufio.Writer
+}
+
+// newPartitionSpool creates n partition files named <name>-NNNN in dir
+func newPartitionSpool(dir, name string, n int) (*partitionSpool, error) {
+	p := &partitionSpool{}
+	for i := 0; i < n; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s-%04d", name, i)))
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.files = append(p.files, f)
+		p.writers = append(p.writers, bufio.NewWriter(f))
+	}
+	return p, nil
+}
+
+// maxSpoolFiles bounds the partition files held open at once by every spool of every
+// join running together. Go raises the soft descriptor limit to the hard one at
+// startup, which leaves room for this on Linux and macOS.
+const maxSpoolFiles = 8192
+
+// partitionCount sizes a spool so each partition gets about perPartition bytes of
+// input. It stays between 1 and limit partitions, limit being the spool's share of
+// maxSpoolFiles.
+func partitionCount(inputBytes, perPartition int64, limit int) int {
+	n := (inputBytes + perPartition - 1) / perPartition
+	return int(min(max(n, 1), int64(max(limit, 1))))
+}
+
+// Partitions is the number of partition files
+func (p *partitionSpool) Partitions() int {
+	return len(p.files)
+}
+
+// Add appends a record to the partition of key. Records must not contain newlines.
+func (p *partitionSpool) Add(key string, record []byte) error {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	w := p.writers[h.Sum32()%uint32(len(p.writers))]
+	if _, err := w.Write(record); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+// Each calls fn for every record of partition i, in the order they were added
+func (p *partitionSpool) Each(i int, fn func(record []byte) error) error {
+	if err := p.writers[i].Flush(); err != nil {
+		return err
+	}
+	if _, err := p.files[i].Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	defer p.files[i].Seek(0, io.SeekEnd)
+
+	r := bufio.NewReader(p.files[i])
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 1 {
+			if err := fn(line[:len(line)-1]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes and deletes every partition file
+func (p *partitionSpool) Close() error {
+	var firstErr error
+	for _, f := range p.files {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
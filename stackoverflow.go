@@ -1,33 +1,325 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"compress/bzip2"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"html"
+	"io"
 	"log"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/bodgit/sevenzip"
 )
 
-// StreamXMLFiles: Finds all .xml files in a directory and emits them as tasks
+// StreamXMLFiles: Finds all Stack Exchange post dumps in a directory (.xml, .xml.gz,
+// .xml.bz2 or per-site .7z archives) and emits them as tasks tagged with their site
 type StreamXMLFiles struct {
 	Directory string
 }
 
 // ProcessStackExchangeXML: Parses XML, links Q&A, and formats text
 type ProcessStackExchangeXML struct {
-	MinScore int
+	MinQuestionScore int // Questions scored lower are skipped (0 = no minimum)
+	MinAnswerScore   int // Answers scored lower are never emitted
+	// TopAnswers emits up to this many answers per question, best score first.
+	// Zero emits the accepted answer only.
+	TopAnswers int
+	// BestWhenUnaccepted falls back to the highest-scored answer when a question
+	// has no accepted answer (only used when TopAnswers is zero)
+	BestWhenUnaccepted bool
+	// Partitions is the number of on-disk partitions used to join questions and
+	// answers. Zero sizes it per dump, PartitionBytes of uncompressed posts per
+	// partition. Only one partition is held in memory at a time.
+	Partitions     int
+	PartitionBytes int64 // 0 = 64 MiB
+	// TempDir holds the partition files (empty = the system temp directory)
+	TempDir string
+	// MaxTurns > 0 joins Comments.xml and emits conversations of at most this many
+	// turns: the question, clarifying comments, the answer and follow-ups under it.
+	// Zero emits plain question/answer pairs.
+	MaxTurns    int
+	IncludeTags []string // Keep only questions with one of these tags, e.g. "go" (empty = all)
+	ExcludeTags []string // Drop questions with any of these tags
+	TopicLine   bool     // Start the user turn with "Topic: go, slices"
+	// Quality filters
+	DropNegative      bool // Skip questions with a negative score
+	DropClosed        bool // Skip questions with a ClosedDate
+	DropDuplicates    bool // Skip questions PostLinks.xml marks as duplicates
+	DropCommunityWiki bool // Skip community wiki questions and answers
+	// Workers is the number of dumps joined at once (0 = one per CPU). Output stays
+	// in file order whatever the number of workers.
+	Workers int
+	// MemoryBudget caps the bytes the workers may hold together, estimated from the
+	// dump sizes (0 = GOMEMLIMIT when set, otherwise 2 GiB). A dump that needs more
+	// than the budget runs alone.
+	MemoryBudget int64
+	// Strict fails a dump on its first malformed row or XML error. By default bad
+	// rows are skipped and counted, and a truncated dump keeps the rows before the
+	// break; both are logged with byte offsets.
+	Strict bool
 }
 
 type Row struct {
-	Id               string `xml:"Id,attr"`
-	PostTypeId       string `xml:"PostTypeId,attr"` // 1=Question, 2=Answer
-	Body             string `xml:"Body,attr"`
-	Title            string `xml:"Title,attr"`
-	AcceptedAnswerId string `xml:"AcceptedAnswerId,attr"`
-	Score            int    `xml:"Score,attr"`
+	Id                 string `xml:"Id,attr"`
+	PostTypeId         string `xml:"PostTypeId,attr"` // 1=Question, 2=Answer
+	ParentId           string `xml:"ParentId,attr"`   // Question of an answer
+	Body               string `xml:"Body,attr"`
+	Title              string `xml:"Title,attr"`
+	AcceptedAnswerId   string `xml:"AcceptedAnswerId,attr"`
+	Score              int    `xml:"Score,attr"`
+	OwnerUserId        string `xml:"OwnerUserId,attr"`
+	Tags               string `xml:"Tags,attr"` // "<go><slices>" or "|go|slices|"
+	ClosedDate         string `xml:"ClosedDate,attr"`
+	CommunityOwnedDate string `xml:"CommunityOwnedDate,attr"`
+}
+
+// Comment is a row of Comments.xml
+type Comment struct {
+	Id           string `xml:"Id,attr"`
+	PostId       string `xml:"PostId,attr"`
+	Text         string `xml:"Text,attr"`
+	UserId       string `xml:"UserId,attr"`
+	CreationDate string `xml:"CreationDate,attr"`
+	QuestionId   string `xml:"-"` // Filled in while joining
+}
+
+// PostLink is a row of PostLinks.xml
+type PostLink struct {
+	PostId        string `xml:"PostId,attr"`
+	RelatedPostId string `xml:"RelatedPostId,attr"`
+	LinkTypeId    string `xml:"LinkTypeId,attr"` // 1=Linked, 3=Duplicate
+}
+
+// companionDumps are the files of a site dump other than Posts.xml
+var companionDumps = []string{"Comments", "PostLinks", "PostHistory", "Users", "Votes", "Badges", "Tags"}
+
+// dumpBaseName strips the archive and compression extensions: "a.com-Posts.7z" -> "a.com-Posts"
+func dumpBaseName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".7z", ".gz", ".bz2", ".xml"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// isCompanionDump reports whether path holds comments, votes etc. rather than posts
+func isCompanionDump(path string) bool {
+	name := dumpBaseName(path)
+	for _, companion := range companionDumps {
+		if strings.EqualFold(name, companion) || strings.HasSuffix(strings.ToLower(name), "-"+strings.ToLower(companion)) {
+			return true
+		}
+	}
+	return false
+}
+
+// siteFromDump names the site of a dump from the archive name: "askubuntu.com.7z"
+// and "stackoverflow.com-Posts.7z". A bare Posts.xml has no site; its directory is
+// wherever it was extracted to, and the IDs must not change when it moves.
+func siteFromDump(path string) string {
+	name := dumpBaseName(path)
+	if strings.EqualFold(name, "Posts") {
+		return ""
+	}
+	return strings.TrimSuffix(name, "-Posts")
+}
+
+// multiCloser closes an archive entry together with its archive
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	var firstErr error
+	for _, c := range m.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openDumpFile opens one XML file of a site dump, e.g. "Posts.xml", given the path
+// emitted by StreamXMLFiles. Archives are searched for the file, then the sibling
+// "<site>-<name>.7z" archive is tried; plain files are looked up next to source with
+// "Posts" replaced in the name. .gz and .bz2 files are decompressed on the fly.
+func openDumpFile(source, name string) (io.ReadCloser, error) {
+	base := strings.TrimSuffix(name, ".xml")
+
+	if strings.HasSuffix(source, ".7z") {
+		candidates := []string{source}
+		if !strings.EqualFold(base, "Posts") {
+			candidates = append(candidates, filepath.Join(filepath.Dir(source), siteFromDump(source)+"-"+base+".7z"))
+		}
+		for _, archive := range candidates {
+			if _, err := os.Stat(archive); err != nil {
+				continue
+			}
+			r, err := sevenzip.OpenReader(archive)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range r.File {
+				if strings.EqualFold(filepath.Base(f.Name), name) {
+					rc, err := f.Open()
+					if err != nil {
+						r.Close()
+						return nil, err
+					}
+					return &multiCloser{Reader: rc, closers: []io.Closer{rc, r}}, nil
+				}
+			}
+			r.Close()
+		}
+		return nil, fmt.Errorf("%s not found for %s: %w", name, source, os.ErrNotExist)
+	}
+
+	paths := []string{source}
+	if !strings.EqualFold(base, "Posts") {
+		dir, file := filepath.Split(source)
+		idx := strings.Index(strings.ToLower(file), "posts")
+		if idx < 0 {
+			return nil, fmt.Errorf("%s not found for %s: %w", name, source, os.ErrNotExist)
+		}
+		stem := file[:idx] + base + file[idx+len("posts"):]
+		stem = strings.TrimSuffix(strings.TrimSuffix(stem, ".gz"), ".bz2")
+		paths = []string{filepath.Join(dir, stem), filepath.Join(dir, stem+".gz"), filepath.Join(dir, stem+".bz2")}
+	}
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasSuffix(path, ".gz"):
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			return &multiCloser{Reader: gz, closers: []io.Closer{gz, file}}, nil
+		case strings.HasSuffix(path, ".bz2"):
+			return &multiCloser{Reader: bzip2.NewReader(file), closers: []io.Closer{file}}, nil
+		}
+		return file, nil
+	}
+	return nil, fmt.Errorf("%s not found for %s: %w", name, source, os.ErrNotExist)
+}
+
+// parseTags splits the Tags attribute, written as "<go><slices>" in older dumps
+// and as "|go|slices|" in newer ones
+func parseTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool {
+		return r == '<' || r == '>' || r == '|'
+	})
+}
+
+// dumpError is a decode error in a dump file, with the byte offset of the
+// (decompressed) XML where it happened
+type dumpError struct {
+	Name   string
+	Offset int64
+	Err    error
+}
+
+func (e *dumpError) Error() string {
+	return fmt.Sprintf("%s: at byte %d: %v", e.Name, e.Offset, e.Err)
+}
+
+func (e *dumpError) Unwrap() error {
+	return e.Err
+}
+
+// decodeStats counts what lenient decoding of a dump left out
+type decodeStats struct {
+	BadRows   int  // Rows skipped because they didn't decode
+	Truncated bool // Reading stopped early at a syntax error
+}
+
+func (s *decodeStats) add(other decodeStats) {
+	s.BadRows += other.BadRows
+	s.Truncated = s.Truncated || other.Truncated
+}
+
+// decodeRows streams the <row> elements of a dump file into fn. In strict mode the
+// first bad row or syntax error fails the file. Otherwise bad rows are skipped and
+// counted, and a syntax error, such as a truncated file, ends the file early while
+// keeping the rows read before it; both are logged with their offsets and returned
+// in the stats.
+func decodeRows[T any](name string, r io.Reader, strict bool, fn func(row *T) error) (decodeStats, error) {
+	decoder := xml.NewDecoder(bufio.NewReaderSize(r, 1<<20))
+	var stats decodeStats
+	defer func() {
+		if stats.BadRows > 0 {
+			log.Printf("%s: skipped %d bad rows.\n", name, stats.BadRows)
+		}
+	}()
+
+	// fatal reports whether err leaves the decoder unusable
+	fatal := func(err error) bool {
+		var syntaxErr *xml.SyntaxError
+		return errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	for {
+		t, err := decoder.Token()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			err = &dumpError{Name: name, Offset: decoder.InputOffset(), Err: err}
+			if strict {
+				return stats, err
+			}
+			log.Printf("Stopped reading %v, keeping the rows before it.\n", err)
+			stats.Truncated = true
+			return stats, nil
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "row" {
+			continue
+		}
+		var row T
+		if err := decoder.DecodeElement(&row, &se); err != nil {
+			err = &dumpError{Name: name, Offset: decoder.InputOffset(), Err: err}
+			if strict {
+				return stats, err
+			}
+			if fatal(err) {
+				log.Printf("Stopped reading %v, keeping the rows before it.\n", err)
+				stats.Truncated = true
+				return stats, nil
+			}
+			if stats.BadRows++; stats.BadRows <= 10 {
+				log.Printf("Skipping bad row in %v\n", err)
+			}
+			continue
+		}
+		if err := fn(&row); err != nil {
+			return stats, err
+		}
+	}
 }
 
 func (s *StreamXMLFiles) Stage(ctx context.Context, in chan Task) chan Task {
@@ -36,24 +328,37 @@ func (s *StreamXMLFiles) Stage(ctx context.Context, in chan Task) chan Task {
 		defer close(out)
 
 		log.Println("Scanning directory:", s.Directory)
-		files, err := filepath.Glob(filepath.Join(s.Directory, "*.xml"))
-		if err != nil {
-			log.Println("Error finding XML files:", err)
-			return
+		var files []string
+		for _, pattern := range []string{"*.xml", "*.xml.gz", "*.xml.bz2", "*.7z"} {
+			matches, err := filepath.Glob(filepath.Join(s.Directory, pattern))
+			if err != nil {
+				log.Println("Error finding XML files:", err)
+				return
+			}
+			for _, file := range matches {
+				// Comments, votes etc. are read next to the posts they belong to
+				if !isCompanionDump(file) {
+					files = append(files, file)
+				}
+			}
 		}
+		slices.Sort(files)
 
 		if len(files) == 0 {
-			log.Println("No .xml files found in", s.Directory)
+			log.Println("No .xml or .7z files found in", s.Directory)
 			return
 		}
 
-		id := 0
 		for _, file := range files {
+			site := siteFromDump(file)
+			task := Task{ID: SampleID("stackexchange", site), Source: file, Metadata: map[string]string{}}
+			if site != "" {
+				task.Metadata["site"] = site
+			}
 			select {
 			case <-ctx.Done():
 				return
-			case out <- Task{ID: id, Source: file}:
-				id++
+			case out <- task:
 			}
 		}
 		log.Printf("Found %d files to process.\n", len(files))
@@ -64,99 +369,604 @@ func (s *StreamXMLFiles) Stage(ctx context.Context, in chan Task) chan Task {
 func (p *ProcessStackExchangeXML) Stage(ctx context.Context, in chan Task) chan Task {
 	out := make(chan Task)
 
-	cleanText := func(input string) string {
-		text := html.UnescapeString(input)
-		text = tagRegex.ReplaceAllString(text, " ") // Remove HTML tags
+	// formatPost renders a title (questions only) and an HTML body as Markdown
+	formatPost := func(title, body string) string {
+		text := htmlToMarkdown(body)
+		if title != "" {
+			text = html.UnescapeString(title) + "\n\n" + text
+		}
+		return strings.TrimSpace(text)
+	}
+
+	// dumpPartitions picks the number of partitions for a dump. Open descriptors are
+	// shared by the workers, so a dump that takes a large share of them has to wait
+	// for the others to finish.
+	dumpPartitions := func(filename string) int {
+		if p.Partitions > 0 {
+			return p.Partitions
+		}
+		return partitionCount(dumpSize(filename), cmp.Or(p.PartitionBytes, 64<<20), maxSpoolFiles/stackJoinSpools)
+	}
+
+	// Questions without an accepted answer only matter if another answer can be picked
+	needsAccepted := p.TopAnswers == 0 && !p.BestWhenUnaccepted
+
+	// wantTags applies IncludeTags and ExcludeTags to the tags of a question
+	wantTags := func(tags []string) bool {
+		has := func(list []string) bool {
+			return slices.ContainsFunc(tags, func(tag string) bool {
+				return slices.ContainsFunc(list, func(t string) bool { return strings.EqualFold(t, tag) })
+			})
+		}
+		if len(p.IncludeTags) > 0 && !has(p.IncludeTags) {
+			return false
+		}
+		return !has(p.ExcludeTags)
+	}
+
+	// Dropped questions by reason, over all files
+	dropped := make(map[string]int)
+	var droppedMu sync.Mutex
+	drop := func(reason string) {
+		droppedMu.Lock()
+		dropped[reason]++
+		droppedMu.Unlock()
+	}
 
-		// Use the global regexes to preserve paragraph/code block structure
-		s := reSpace.ReplaceAllString(text, " ")
-		return strings.TrimSpace(reNewlines.ReplaceAllString(s, "\n\n"))
+	// questionDropReason names the filter a question fails, if any
+	questionDropReason := func(q *Row) string {
+		switch {
+		case p.DropClosed && q.ClosedDate != "":
+			return "closed"
+		case p.DropCommunityWiki && q.CommunityOwnedDate != "":
+			return "community_wiki"
+		case p.DropNegative && q.Score < 0:
+			return "negative_score"
+		case p.MinQuestionScore != 0 && q.Score < p.MinQuestionScore:
+			return "low_score"
+		case q.AcceptedAnswerId == "" && needsAccepted:
+			return "no_accepted_answer"
+		case !wantTags(parseTags(q.Tags)):
+			return "tags"
+		}
+		return ""
 	}
 
-	parseAndLinkXML := func(filename string, minScore int) []string {
-		xmlFile, err := os.Open(filename)
+	// spoolDuplicates collects the questions closed as duplicates of another one,
+	// keyed like the questions. Without a PostLinks.xml it returns nil.
+	spoolDuplicates := func(filename, tmp string, partitions int, stats *decodeStats) (*partitionSpool, error) {
+		linksFile, err := openDumpFile(filename, "PostLinks.xml")
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("No PostLinks.xml for %s, keeping duplicates.\n", filepath.Base(filename))
+			return nil, nil
+		}
 		if err != nil {
-			log.Printf("Error opening %s: %v", filename, err)
-			return nil
+			return nil, err
+		}
+		defer linksFile.Close()
+
+		duplicates, err := newPartitionSpool(tmp, "duplicates", partitions)
+		if err != nil {
+			return nil, err
+		}
+		linkStats, err := decodeRows(dumpBaseName(filename)+" PostLinks.xml", linksFile, p.Strict, func(link *PostLink) error {
+			if link.LinkTypeId != "3" || link.PostId == "" {
+				return nil
+			}
+			return duplicates.Add(link.PostId, []byte(link.PostId))
+		})
+		stats.add(linkStats)
+		if err != nil {
+			duplicates.Close()
+			return nil, err
+		}
+		return duplicates, nil
+	}
+
+	// pickAnswers chooses the answers of a question that become samples
+	pickAnswers := func(q *Row, answers []*Row) []*Row {
+		slices.SortStableFunc(answers, func(a, b *Row) int {
+			if c := cmp.Compare(b.Score, a.Score); c != 0 {
+				return c
+			}
+			return compareNumeric(a.Id, b.Id)
+		})
+		if p.TopAnswers > 0 {
+			return answers[:min(p.TopAnswers, len(answers))]
+		}
+		for _, a := range answers {
+			if a.Id == q.AcceptedAnswerId {
+				return []*Row{a}
+			}
+		}
+		if p.BestWhenUnaccepted && q.AcceptedAnswerId == "" && len(answers) > 0 {
+			return answers[:1]
+		}
+		return nil
+	}
+
+	// spoolComments scatters the comments of a dump by the question they belong to,
+	// directly or through one of the answers in parents. Without a Comments.xml next
+	// to the posts it returns nil.
+	spoolComments := func(filename, tmp string, partitions int, parents *partitionSpool, stats *decodeStats) (*partitionSpool, error) {
+		commentsFile, err := openDumpFile(filename, "Comments.xml")
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("No Comments.xml for %s, emitting plain pairs.\n", filepath.Base(filename))
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer commentsFile.Close()
+
+		// 1. By post, which lines them up with the answer -> question records
+		byPost, err := newPartitionSpool(tmp, "comments-by-post", partitions)
+		if err != nil {
+			return nil, err
+		}
+		defer byPost.Close()
+		commentStats, err := decodeRows(dumpBaseName(filename)+" Comments.xml", commentsFile, p.Strict, func(c *Comment) error {
+			if c.PostId == "" || strings.TrimSpace(c.Text) == "" {
+				return nil
+			}
+			record, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			return byPost.Add(c.PostId, record)
+		})
+		stats.add(commentStats)
+		if err != nil {
+			return nil, err
+		}
+
+		// 2. By question, so they join together with the posts
+		byQuestion, err := newPartitionSpool(tmp, "comments", partitions)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < partitions; i++ {
+			questionOf := make(map[string]string)
+			err := parents.Each(i, func(record []byte) error {
+				var r Row
+				if err := json.Unmarshal(record, &r); err != nil {
+					return err
+				}
+				questionOf[r.Id] = r.ParentId
+				return nil
+			})
+			if err == nil {
+				err = byPost.Each(i, func(record []byte) error {
+					var c Comment
+					if err := json.Unmarshal(record, &c); err != nil {
+						return err
+					}
+					c.QuestionId = cmp.Or(questionOf[c.PostId], c.PostId)
+					record, err := json.Marshal(&c)
+					if err != nil {
+						return err
+					}
+					return byQuestion.Add(c.QuestionId, record)
+				})
+			}
+			if err != nil {
+				byQuestion.Close()
+				return nil, err
+			}
+		}
+		return byQuestion, nil
+	}
+
+	// conversation lays out a question/answer pair and the comments under both as at
+	// most MaxTurns turns. Under the question the asker is the user and other
+	// commenters ask for clarification as the bot; under the answer the answerer is
+	// the bot and everyone else follows up as the user.
+	conversation := func(q, a *Row, qText, aText string, comments map[string][]*Comment) []Turn {
+		maxTurns := max(p.MaxTurns, 2)
+		turns := []Turn{{Role: "user", Text: qText}}
+		add := func(role, text string) {
+			if last := &turns[len(turns)-1]; last.Role == role {
+				last.Text += "\n\n" + text
+				return
+			}
+			turns = append(turns, Turn{Role: role, Text: text})
+		}
+
+		for _, c := range comments[q.Id] {
+			role := "bot"
+			if q.OwnerUserId != "" && c.UserId == q.OwnerUserId {
+				role = "user"
+			}
+			add(role, strings.TrimSpace(c.Text))
+		}
+		// The answer needs room and must reply to a user turn, so an unanswered
+		// clarification is dropped
+		turns = turns[:min(len(turns), maxTurns-1)]
+		for turns[len(turns)-1].Role != "user" {
+			turns = turns[:len(turns)-1]
+		}
+
+		add("bot", aText)
+		for _, c := range comments[a.Id] {
+			role := "user"
+			if a.OwnerUserId != "" && c.UserId == a.OwnerUserId {
+				role = "bot"
+			}
+			add(role, strings.TrimSpace(c.Text))
+		}
+		// Samples end on a bot turn
+		turns = turns[:min(len(turns), maxTurns)]
+		for turns[len(turns)-1].Role != "bot" {
+			turns = turns[:len(turns)-1]
+		}
+		return turns
+	}
+
+	// parseAndLinkXML joins questions to their answers without holding the dump in
+	// memory: rows are scattered over on-disk partitions by question id, then each
+	// partition is joined on its own. emit returns false to stop early. The stats
+	// cover the posts and the companion dumps read with them.
+	parseAndLinkXML := func(filename string, partitions int, emit func(turns []Turn, metadata map[string]string) bool) (int, decodeStats, error) {
+		var stats decodeStats
+		xmlFile, err := openDumpFile(filename, "Posts.xml")
+		if err != nil {
+			return 0, stats, err
 		}
 		defer xmlFile.Close()
 
-		decoder := xml.NewDecoder(xmlFile)
+		tmp, err := os.MkdirTemp(p.TempDir, "stack-join-")
+		if err != nil {
+			return 0, stats, err
+		}
+		defer os.RemoveAll(tmp)
 
-		questions := make(map[string]*Row)
-		answers := make(map[string]string)
-		var results []string
+		questions, err := newPartitionSpool(tmp, "questions", partitions)
+		if err != nil {
+			return 0, stats, err
+		}
+		defer questions.Close()
+		answers, err := newPartitionSpool(tmp, "answers", partitions)
+		if err != nil {
+			return 0, stats, err
+		}
+		defer answers.Close()
+
+		// Answers are spooled by their question, so comments on an answer need the
+		// answer -> question mapping to find their partition
+		var parents *partitionSpool
+		if p.MaxTurns > 0 {
+			if parents, err = newPartitionSpool(tmp, "parents", partitions); err != nil {
+				return 0, stats, err
+			}
+			defer parents.Close()
+		}
 
 		// Stream XML
-		for {
-			t, _ := decoder.Token()
-			if t == nil {
-				break
-			}
-
-			switch se := t.(type) {
-			case xml.StartElement:
-				if se.Name.Local == "row" {
-					var row Row
-					if err := decoder.DecodeElement(&row, &se); err != nil {
-						continue
+		stats, err = decodeRows(filepath.Base(filename), xmlFile, p.Strict, func(row *Row) error {
+			// Is Question?
+			if row.PostTypeId == "1" {
+				if reason := questionDropReason(row); reason != "" {
+					drop(reason)
+					return nil
+				}
+				record, err := json.Marshal(row)
+				if err != nil {
+					return err
+				}
+				if err := questions.Add(row.Id, record); err != nil {
+					return err
+				}
+			}
+			// Is Answer?
+			if row.PostTypeId == "2" && row.Score >= p.MinAnswerScore &&
+				(!p.DropCommunityWiki || row.CommunityOwnedDate == "") {
+				record, err := json.Marshal(row)
+				if err != nil {
+					return err
+				}
+				if err := answers.Add(row.ParentId, record); err != nil {
+					return err
+				}
+				if parents != nil {
+					record, err := json.Marshal(&Row{Id: row.Id, ParentId: row.ParentId})
+					if err != nil {
+						return err
 					}
+					return parents.Add(row.Id, record)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, stats, err
+		}
+
+		var comments *partitionSpool
+		if p.MaxTurns > 0 {
+			if comments, err = spoolComments(filename, tmp, partitions, parents, &stats); err != nil {
+				return 0, stats, err
+			}
+			if comments != nil {
+				defer comments.Close()
+			}
+		}
+
+		var duplicates *partitionSpool
+		if p.DropDuplicates {
+			if duplicates, err = spoolDuplicates(filename, tmp, partitions, &stats); err != nil {
+				return 0, stats, err
+			}
+			if duplicates != nil {
+				defer duplicates.Close()
+			}
+		}
 
-					// Is Question?
-					if row.PostTypeId == "1" && row.AcceptedAnswerId != "" {
-						questions[row.Id] = &row
+		// Link, one partition at a time
+		count := 0
+		for i := 0; i < partitions; i++ {
+			byID := make(map[string]*Row)
+			err := questions.Each(i, func(record []byte) error {
+				var q Row
+				if err := json.Unmarshal(record, &q); err != nil {
+					return err
+				}
+				byID[q.Id] = &q
+				return nil
+			})
+			if err != nil {
+				return count, stats, err
+			}
+			if duplicates != nil {
+				err = duplicates.Each(i, func(record []byte) error {
+					if _, exists := byID[string(record)]; exists {
+						delete(byID, string(record))
+						drop("duplicate")
 					}
-					// Is Answer?
-					if row.PostTypeId == "2" && row.Score >= minScore {
-						answers[row.Id] = row.Body
+					return nil
+				})
+				if err != nil {
+					return count, stats, err
+				}
+			}
+
+			byQuestion := make(map[string][]*Row)
+			err = answers.Each(i, func(record []byte) error {
+				var a Row
+				if err := json.Unmarshal(record, &a); err != nil {
+					return err
+				}
+				if _, exists := byID[a.ParentId]; exists {
+					byQuestion[a.ParentId] = append(byQuestion[a.ParentId], &a)
+				}
+				return nil
+			})
+			if err != nil {
+				return count, stats, err
+			}
+
+			// Comments of the questions and answers in this partition, by post
+			byPost := make(map[string][]*Comment)
+			if comments != nil {
+				err = comments.Each(i, func(record []byte) error {
+					var c Comment
+					if err := json.Unmarshal(record, &c); err != nil {
+						return err
+					}
+					if _, exists := byQuestion[c.QuestionId]; exists {
+						byPost[c.PostId] = append(byPost[c.PostId], &c)
 					}
+					return nil
+				})
+				if err != nil {
+					return count, stats, err
+				}
+				for _, thread := range byPost {
+					slices.SortStableFunc(thread, func(a, b *Comment) int {
+						if c := strings.Compare(a.CreationDate, b.CreationDate); c != 0 {
+							return c
+						}
+						return compareNumeric(a.Id, b.Id)
+					})
 				}
 			}
-		}
 
-		// Link
-		for _, q := range questions {
-			if ansBody, exists := answers[q.AcceptedAnswerId]; exists {
-				qText := cleanText(q.Title + " " + q.Body)
-				aText := cleanText(ansBody)
+			// Emit in id order so every run produces the same file
+			ids := slices.Collect(maps.Keys(byQuestion))
+			slices.SortFunc(ids, compareNumeric)
+			for _, id := range ids {
+				q := byID[id]
+				qText := formatPost(q.Title, q.Body)
+				tags := parseTags(q.Tags)
+				if p.TopicLine && len(tags) > 0 {
+					qText = "Topic: " + strings.Join(tags, ", ") + "\n\n" + qText
+				}
+
+				for _, a := range pickAnswers(q, byQuestion[id]) {
+					aText := formatPost("", a.Body)
 
-				// Format: <user>: ... <bot>: ...
-				formatted := fmt.Sprintf("<user>: %s\n<bot>: %s\n<eos>\n", qText, aText)
-				results = append(results, formatted)
+					turns := []Turn{{Role: "user", Text: qText}, {Role: "bot", Text: aText}}
+					metadata := map[string]string{
+						"question_id":    q.Id,
+						"answer_id":      a.Id,
+						"question_score": strconv.Itoa(q.Score),
+						"score":          strconv.Itoa(a.Score),
+						"accepted":       strconv.FormatBool(a.Id == q.AcceptedAnswerId),
+						"tags":           strings.Join(tags, ","),
+					}
+					if comments != nil {
+						turns = conversation(q, a, qText, aText, byPost)
+						metadata["turns"] = strconv.Itoa(len(turns))
+					}
+					if !emit(turns, metadata) {
+						return count, stats, ctx.Err()
+					}
+					count++
+				}
 			}
 		}
-		return results
+		return count, stats, nil
 	}
 
 	go func() {
 		defer close(out)
 
-		// Process files sequentially to save RAM
-		for task := range in {
-			select {
-			case <-ctx.Done():
-				return
-			default:
+		workers := p.Workers
+		if workers == 0 {
+			workers = runtime.NumCPU()
+		}
+		budget := p.MemoryBudget
+		if budget == 0 {
+			budget = debug.SetMemoryLimit(-1)
+			if budget == math.MaxInt64 {
+				budget = 2 << 30
 			}
+		}
+		memory := newBudgetLimiter(budget)
+		descriptors := newBudgetLimiter(maxSpoolFiles)
 
-			log.Println("Processing File:", task.Source)
+		// Files are started in order and each one sends into its own channel, which
+		// is drained in the same order, so the output doesn't depend on timing
+		files := make(chan chan Task, workers)
+		go func() {
+			defer close(files)
+			sem := make(chan struct{}, workers)
 
-			// We process the ENTIRE file here and emit multiple tasks (one per Q&A pair)
-			pairs := parseAndLinkXML(task.Source, p.MinScore)
+			for task := range in {
+				select {
+				case <-ctx.Done():
+					return
+				case sem <- struct{}{}:
+				}
+				partitions := dumpPartitions(task.Source)
+				fds := descriptors.Acquire(int64(partitions * stackJoinSpools))
+				need := memory.Acquire(joinMemory(task.Source, partitions))
 
-			for i, content := range pairs {
+				samples := make(chan Task, 256)
 				select {
 				case <-ctx.Done():
+					memory.Release(need)
+					descriptors.Release(fds)
 					return
-				case out <- Task{
-					ID:      (task.ID * 1000000) + i, // Unique ID generation
-					Source:  task.Source,
-					Content: content,
-				}:
+				case files <- samples:
+				}
+
+				go func(task Task) {
+					defer func() {
+						memory.Release(need)
+						descriptors.Release(fds)
+						<-sem
+					}()
+					defer close(samples)
+
+					log.Printf("Processing File: %s (%d partitions)\n", task.Source, partitions)
+
+					// We process the ENTIRE file here and emit multiple tasks (one per Q&A pair)
+					site := siteFromDump(task.Source)
+					pairs, stats, err := parseAndLinkXML(task.Source, partitions, func(turns []Turn, metadata map[string]string) bool {
+						if site != "" {
+							metadata["site"] = site
+						}
+						select {
+						case <-ctx.Done():
+							return false
+						case samples <- Task{
+							ID:       SampleID("stackexchange", site, metadata["question_id"], metadata["answer_id"]),
+							Source:   task.Source,
+							Content:  formatDialogue(turns),
+							Turns:    turns,
+							Metadata: metadata,
+						}:
+							return true
+						}
+					})
+					if err != nil {
+						log.Printf("Error processing %s: %v", task.Source, err)
+						return
+					}
+					log.Printf("Finished %s. Extracted %d pairs, skipped %d bad rows, truncated: %v.\n",
+						filepath.Base(task.Source), pairs, stats.BadRows, stats.Truncated)
+				}(task)
+			}
+		}()
+
+		for samples := range files {
+			for sample := range samples {
+				select {
+				case <-ctx.Done():
+					return
+				case out <- sample:
 				}
 			}
-			log.Printf("Finished %s. Extracted %d pairs.\n", filepath.Base(task.Source), len(pairs))
 		}
+		log.Printf("Stack Exchange filter dropped questions: %v\n", dropped)
 	}()
 	return out
-}
\ No newline at end of file
+}
+
+// dumpSize estimates the uncompressed size of a dump
+func dumpSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	size := info.Size()
+	if !strings.HasSuffix(path, ".xml") {
+		// Compressed dumps expand several times over
+		size *= 8
+	}
+	return size
+}
+
+// joinMemory estimates the bytes joining a dump takes: one partition of its
+// uncompressed posts, decoded into rows
+func joinMemory(path string, partitions int) int64 {
+	return max(dumpSize(path)/int64(partitions)*4, 32<<20)
+}
+
+// stackJoinSpools is the most partition spools a dump join holds open at once:
+// questions, answers and parents, with either both comment spools or the comments
+// and duplicates
+const stackJoinSpools = 5
+
+// budgetLimiter hands out a budget, bytes of memory or open files, to concurrent jobs
+type budgetLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	free  int64
+	total int64
+}
+
+func newBudgetLimiter(total int64) *budgetLimiter {
+	m := &budgetLimiter{free: total, total: total}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// Acquire blocks until n units are free and returns the amount taken, which is
+// capped at the whole budget so an oversized job can still run on its own
+func (m *budgetLimiter) Acquire(n int64) int64 {
+	n = min(n, m.total)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.free < n {
+		m.cond.Wait()
+	}
+	m.free -= n
+	return n
+}
+
+// Release returns n units taken by Acquire
+func (m *budgetLimiter) Release(n int64) {
+	m.mu.Lock()
+	m.free += n
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// compareNumeric orders numeric ids such as "9" < "10"
+func compareNumeric(a, b string) int {
+	if len(a) != len(b) {
+		return cmp.Compare(len(a), len(b))
+	}
+	return strings.Compare(a, b)
+}
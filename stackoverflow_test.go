@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRows(t *testing.T) {
+	const rows = `<?xml version="1.0" encoding="utf-8"?>
+<posts>
+  <row Id="1" PostTypeId="1" Score="5" />
+  <row Id="2" PostTypeId="2" Score="high" />
+  <row Id="3" PostTypeId="2" Score="2" />
+  <row Id="4" PostTypeId="2" Score="" />
+  <row Id="5" PostTypeId="2" Score="1" />
+</posts>
+`
+	tests := []struct {
+		name    string
+		xml     string
+		strict  bool
+		ids     []string
+		stats   decodeStats
+		wantErr bool
+	}{
+		{name: "bad rows", xml: rows, ids: []string{"1", "3", "4", "5"}, stats: decodeStats{BadRows: 1}},
+		{name: "truncated", xml: rows[:strings.Index(rows, `<row Id="5"`)+12], ids: []string{"1", "3", "4"}, stats: decodeStats{BadRows: 1, Truncated: true}},
+		{name: "strict", xml: rows, strict: true, ids: []string{"1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []string
+			stats, err := decodeRows("Posts.xml", strings.NewReader(tt.xml), tt.strict, func(row *Row) error {
+				ids = append(ids, row.Id)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v", err)
+			}
+			if !slices.Equal(ids, tt.ids) {
+				t.Errorf("ids = %q, want %q", ids, tt.ids)
+			}
+			if !tt.wantErr && stats != tt.stats {
+				t.Errorf("stats = %+v, want %+v", stats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestProcessStackExchangeXML(t *testing.T) {
+	files := runStage(t, &StreamXMLFiles{Directory: filepath.Join("testdata", "stack")})
+	var sources []string
+	for _, file := range files {
+		sources = append(sources, file.Source)
+	}
+	// Comments.xml and PostLinks.xml are read next to the posts, not as dumps
+	want := []string{filepath.Join("testdata", "stack", "Posts.xml"), filepath.Join("testdata", "stack", "golang.stackexchange.com-Posts.xml")}
+	if !slices.Equal(sources, want) {
+		t.Fatalf("sources = %q, want %q", sources, want)
+	}
+
+	const reverse = "How do I reverse a slice in Go?\n\nI have a `[]int` and want it in reverse order."
+	const buffered = "When should a channel be buffered?\n\nUnbuffered channels block. When do I want a buffer?"
+	tests := []struct {
+		site, question, answer string
+		turns                  []Turn
+		metadata               map[string]string
+	}{
+		// The accepted answer after the clarifying comments; the follow-ups under it
+		// don't fit in MaxTurns
+		{
+			question: "1", answer: "3",
+			turns: []Turn{
+				{"user", reverse},
+				{"bot", "Which Go version are you on?"},
+				{"user", "Go 1.22."},
+				{"bot", "Since Go 1.21 use `slices.Reverse(s)`."},
+			},
+			metadata: map[string]string{"accepted": "true", "question_score": "12", "score": "20", "tags": "go,slices", "turns": "4"},
+		},
+		// The second best answer; the negatively scored one is never emitted
+		{
+			question: "1", answer: "2",
+			turns: []Turn{
+				{"user", reverse},
+				{"bot", "Which Go version are you on?"},
+				{"user", "Go 1.22."},
+				{"bot", "Swap from both ends:\n\n```\nfor i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {\n    s[i], s[j] = s[j], s[i]\n}\n```"},
+			},
+			metadata: map[string]string{"accepted": "false", "question_score": "12", "score": "4", "tags": "go,slices", "turns": "4"},
+		},
+		// No accepted answer, the two best ones; a trailing follow-up is left out
+		{
+			question: "11", answer: "13",
+			turns:    []Turn{{"user", buffered}, {"bot", "When the sender must not wait for the receiver, e.g. a semaphore."}},
+			metadata: map[string]string{"accepted": "false", "question_score": "5", "score": "8", "tags": "go,channels", "turns": "2"},
+		},
+		{
+			question: "11", answer: "14",
+			turns:    []Turn{{"user", buffered}, {"bot", "To absorb bursts."}},
+			metadata: map[string]string{"accepted": "false", "question_score": "5", "score": "3", "tags": "go,channels", "turns": "2"},
+		},
+		// A dump without Comments.xml gives plain pairs. Only a named dump has a site,
+		// a bare Posts.xml doesn't take one from its directory.
+		{
+			site: "golang.stackexchange.com", question: "1", answer: "2",
+			turns:    []Turn{{"user", "What does go vet check?\n\nIs it a linter?"}, {"bot", "It reports suspicious constructs such as bad `Printf` verbs."}},
+			metadata: map[string]string{"accepted": "true", "question_score": "2", "score": "3", "tags": "go,tooling"},
+		},
+	}
+
+	// Closed (5), duplicate (7), negatively scored (9), excluded (15) and
+	// not included (17) questions are dropped
+	out := runStage(t, &ProcessStackExchangeXML{
+		TopAnswers:     2,
+		Partitions:     3,
+		MaxTurns:       4,
+		IncludeTags:    []string{"go"},
+		ExcludeTags:    []string{"cgo"},
+		DropNegative:   true,
+		DropClosed:     true,
+		DropDuplicates: true,
+		Workers:        2,
+	}, files...)
+	if len(out) != len(tests) {
+		t.Fatalf("got %d samples, want %d", len(out), len(tests))
+	}
+	for i, tt := range tests {
+		got := out[i]
+		if tt.site != "" {
+			tt.metadata["site"] = tt.site
+		}
+		tt.metadata["question_id"] = tt.question
+		tt.metadata["answer_id"] = tt.answer
+		if id := SampleID("stackexchange", tt.site, tt.question, tt.answer); got.ID != id {
+			t.Errorf("sample %d: id = %q, want %q", i, got.ID, id)
+		}
+		if !slices.Equal(got.Turns, tt.turns) {
+			t.Errorf("sample %d: turns = %q, want %q", i, got.Turns, tt.turns)
+		}
+		if got.Content != formatDialogue(tt.turns) {
+			t.Errorf("sample %d: content = %q", i, got.Content)
+		}
+		if !maps.Equal(got.Metadata, tt.metadata) {
+			t.Errorf("sample %d: metadata = %q, want %q", i, got.Metadata, tt.metadata)
+		}
+	}
+}
+
+func TestQuestionScoreFilters(t *testing.T) {
+	files := runStage(t, &StreamXMLFiles{Directory: filepath.Join("testdata", "stack")})
+	tests := []struct {
+		name      string
+		stage     ProcessStackExchangeXML
+		questions []string
+	}{
+		{name: "default keeps negative questions", questions: []string{"1", "5", "7", "9", "11", "15", "17"}},
+		{name: "drop negative", stage: ProcessStackExchangeXML{DropNegative: true}, questions: []string{"1", "5", "7", "11", "15", "17"}},
+		{name: "minimum", stage: ProcessStackExchangeXML{MinQuestionScore: 6}, questions: []string{"1", "15", "17"}},
+		{name: "negative minimum", stage: ProcessStackExchangeXML{MinQuestionScore: -2}, questions: []string{"1", "5", "7", "11", "15", "17"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.stage.TopAnswers = 1
+			var questions []string
+			for _, sample := range runStage(t, &tt.stage, files[0]) {
+				questions = append(questions, sample.Metadata["question_id"])
+			}
+			if !slices.Equal(questions, tt.questions) {
+				t.Errorf("questions = %q, want %q", questions, tt.questions)
+			}
+		})
+	}
+}
+
+func TestSiteFromDump(t *testing.T) {
+	tests := map[string]string{
+		"dumps/askubuntu.com.7z":                     "askubuntu.com",
+		"dumps/stackoverflow.com-Posts.7z":           "stackoverflow.com",
+		"dumps/superuser.com-Posts.xml.gz":           "superuser.com",
+		"dumps/math.stackexchange.com-Posts.xml.bz2": "math.stackexchange.com",
+		"xml_dump/Posts.xml":                         "",
+		"xml_dump/Posts.xml.gz":                      "",
+	}
+	for path, want := range tests {
+		if got := siteFromDump(filepath.FromSlash(path)); got != want {
+			t.Errorf("siteFromDump(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestOpenDumpFile(t *testing.T) {
+	dir := filepath.Join("testdata", "stack", "dumps")
+	files := runStage(t, &StreamXMLFiles{Directory: dir})
+	var sources []string
+	for _, file := range files {
+		sources = append(sources, filepath.Base(file.Source))
+	}
+	want := []string{"askubuntu.com.7z", "math.stackexchange.com-Posts.xml.bz2", "stackoverflow.com-Posts.7z", "superuser.com-Posts.xml.gz"}
+	if !slices.Equal(sources, want) {
+		t.Fatalf("sources = %q, want %q", sources, want)
+	}
+
+	tests := []struct {
+		source string
+		name   string
+		want   string // Text of the only row, empty when the file is missing
+	}{
+		{source: "askubuntu.com.7z", name: "Posts.xml", want: "askubuntu.com posts"},
+		{source: "askubuntu.com.7z", name: "Comments.xml", want: "askubuntu.com comments"},
+		{source: "askubuntu.com.7z", name: "PostLinks.xml"},
+		{source: "stackoverflow.com-Posts.7z", name: "Posts.xml", want: "stackoverflow.com posts"},
+		{source: "stackoverflow.com-Posts.7z", name: "Comments.xml", want: "stackoverflow.com comments"},
+		{source: "superuser.com-Posts.xml.gz", name: "Posts.xml", want: "superuser.com posts"},
+		{source: "superuser.com-Posts.xml.gz", name: "Comments.xml", want: "superuser.com comments"},
+		{source: "math.stackexchange.com-Posts.xml.bz2", name: "Posts.xml", want: "math.stackexchange.com posts"},
+		{source: "math.stackexchange.com-Posts.xml.bz2", name: "PostLinks.xml", want: "math.stackexchange.com postlinks"},
+		{source: "math.stackexchange.com-Posts.xml.bz2", name: "Comments.xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source+"/"+tt.name, func(t *testing.T) {
+			r, err := openDumpFile(filepath.Join(dir, tt.source), tt.name)
+			if tt.want == "" {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("err = %v, want os.ErrNotExist", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			var texts []string
+			_, err = decodeRows(tt.name, r, true, func(row *struct {
+				Text string `xml:"Text,attr"`
+			}) error {
+				texts = append(texts, row.Text)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(texts, []string{tt.want}) {
+				t.Errorf("rows = %q, want %q", texts, tt.want)
+			}
+		})
+	}
+}
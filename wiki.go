@@ -3,14 +3,197 @@ package main
 import (
 	"bytes"
 	"context"
+	"html"
 	"log"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"unicode"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+// Page kinds assigned by classifyWikiPage
+const (
+	PageArticle        = "article"
+	PageDisambiguation = "disambiguation"
+	PageStub           = "stub"
+	PageList           = "list"
+)
+
 type ExtractTextWiki struct {
+	// DropKinds lists the page kinds that are skipped. Pages of every other
+	// kind are kept and tagged with their kind in the task metadata.
+	DropKinds []string
+
+	// ChunkTokens splits every article at section boundaries into samples of at
+	// most this many tokens. Zero emits one sample per article.
+	ChunkTokens int
+}
+
+// Page layouts understood by ExtractTextWiki
+const (
+	layoutDesktop    = "desktop"     // Vector and MonoBook skins, with or without .mw-heading wrappers
+	layoutMobile     = "mobile"      // Minerva skin served on *.m.wikipedia.org
+	layoutParsoid    = "parsoid"     // REST API page/html, <section> wrapped Parsoid output
+	layoutMobileHTML = "mobile-html" // REST API page/mobile-html from the Page Content Service
+)
+
+// detectWikiLayout tells which kind of Wikipedia HTML the document is
+func detectWikiLayout(doc *goquery.Document) string {
+	switch {
+	case doc.Find("#pcs, .pcs-edit-section-header, .pcs-edit-section-title").Length() > 0:
+		return layoutMobileHTML
+	case doc.Find(`body.parsoid-body, meta[property="mw:htmlVersion"], section[data-mw-section-id]`).Length() > 0 &&
+		doc.Find("#mw-content-text").Length() == 0:
+		return layoutParsoid
+	case doc.Find("body.skin-minerva, #mw-mf-viewport, .mf-section-0").Length() > 0:
+		return layoutMobile
+	}
+	return layoutDesktop
+}
+
+// wikiTitleAndContent returns the raw page title and the element holding the article body
+func wikiTitleAndContent(doc *goquery.Document, layout string) (string, *goquery.Selection) {
+	var title string
+	var content *goquery.Selection
+
+	switch layout {
+	case layoutMobileHTML:
+		title = doc.Find("header h1, h1.pcs-edit-section-title").First().Text()
+		content = doc.Find("#pcs")
+	case layoutParsoid:
+		// Parsoid pages have no visible heading, only the <title>
+		title = doc.Find("title").First().Text()
+		content = doc.Find("body")
+	default:
+		// Wikipedia titles usually have the ID "firstHeading"
+		title = doc.Find("#firstHeading").First().Text()
+		content = doc.Find(".mw-parser-output").First()
+		if content.Length() == 0 {
+			content = doc.Find("#mw-content-text")
+		}
+	}
+
+	// Fallbacks for unknown skins
+	if strings.TrimSpace(title) == "" {
+		title = doc.Find("h1").First().Text()
+	}
+	if strings.TrimSpace(title) == "" {
+		title = strings.TrimSuffix(doc.Find("title").First().Text(), " - Wikipedia")
+	}
+	if content.Length() == 0 {
+		content = doc.Find("body")
+	}
+
+	return title, content
+}
+
+// wikiPage is what classifyWikiPage learns about a page from its markers
+type wikiPage struct {
+	Kind         string
+	Title        string // From the canonical link, empty if there is none
+	CanonicalURL string
+}
+
+// classifyWikiPage detects disambiguation, list and stub pages from their message boxes
+// and categories, and resolves the canonical URL and title of the article.
+func classifyWikiPage(doc *goquery.Document) wikiPage {
+	page := wikiPage{Kind: PageArticle}
+
+	// Parsoid output links the article with dc:isVersionOf instead of rel=canonical
+	if href, ok := doc.Find(`link[rel="canonical"], link[rel="dc:isVersionOf"]`).First().Attr("href"); ok {
+		if strings.HasPrefix(href, "//") {
+			href = "https:" + href
+		}
+		page.CanonicalURL = href
+		if u, err := url.Parse(href); err == nil {
+			if _, name, found := strings.Cut(u.Path, "/wiki/"); found {
+				page.Title = strings.ReplaceAll(name, "_", " ")
+			}
+		}
+	}
+
+	var categories []string
+	doc.Find("#catlinks li a").Each(func(i int, s *goquery.Selection) {
+		categories = append(categories, strings.ToLower(strings.TrimSpace(s.Text())))
+	})
+	doc.Find(`link[rel="mw:PageProp/Category"]`).Each(func(i int, s *goquery.Selection) {
+		href := s.AttrOr("href", "")
+		href, _, _ = strings.Cut(href, "#")
+		if _, name, found := strings.Cut(href, "Category:"); found {
+			if name, err := url.PathUnescape(name); err == nil {
+				categories = append(categories, strings.ToLower(strings.ReplaceAll(name, "_", " ")))
+			}
+		}
+	})
+	hasCategory := func(match func(string) bool) bool {
+		return slices.ContainsFunc(categories, match)
+	}
+
+	title := strings.ToLower(page.Title)
+	if title == "" {
+		title = strings.ToLower(strings.TrimSpace(doc.Find("#firstHeading").First().Text()))
+	}
+
+	switch {
+	case doc.Find(`#disambigbox, .dmbox-disambig, .disambigbox, meta[property="mw:PageProp/disambiguation"]`).Length() > 0,
+		hasCategory(func(c string) bool { return strings.HasSuffix(c, "disambiguation pages") }):
+		page.Kind = PageDisambiguation
+	case strings.HasPrefix(title, "list of "), strings.HasPrefix(title, "lists of "),
+		hasCategory(func(c string) bool { return strings.HasPrefix(c, "lists of ") }):
+		page.Kind = PageList
+	case doc.Find(".asbox, .stub").Length() > 0,
+		hasCategory(func(c string) bool { return strings.HasSuffix(c, " stubs") || c == "all stub articles" }):
+		page.Kind = PageStub
+	}
+
+	return page
+}
+
+// reTexWrapper matches the {\displaystyle ...} wrapper MediaWiki puts around TeX sources
+var reTexWrapper = regexp.MustCompile(`(?s)^\{\\(?:displaystyle|textstyle|scriptstyle)\s*(.*)\}$`)
+
+// replaceMathWithLaTeX swaps every rendered formula below s for its TeX source,
+// wrapped in $...$ (inline) or $$...$$ (display), so that s.Text() keeps it readable.
+func replaceMathWithLaTeX(s *goquery.Selection) {
+	s.Find(".mwe-math-element, math").Each(func(i int, m *goquery.Selection) {
+		// Bare <math> inside a .mwe-math-element is handled together with its wrapper
+		if goquery.NodeName(m) == "math" && m.ParentsFiltered(".mwe-math-element").Length() > 0 {
+			return
+		}
+
+		// Prefer the annotation, then the MathML alttext, then the fallback image alt
+		tex := strings.TrimSpace(m.Find(`annotation[encoding="application/x-tex"]`).First().Text())
+		if tex == "" {
+			tex, _ = m.Find("math").AddBack().Filter("math").First().Attr("alttext")
+		}
+		if tex == "" {
+			tex, _ = m.Find("img").First().Attr("alt")
+		}
+		tex = strings.TrimSpace(tex)
+		if tex == "" {
+			m.Remove()
+			return
+		}
+		if sub := reTexWrapper.FindStringSubmatch(tex); sub != nil {
+			tex = strings.TrimSpace(sub[1])
+		}
+
+		display := m.HasClass("mwe-math-element-block") ||
+			m.Find(".mwe-math-mathml-display, .mwe-math-fallback-image-display").Length() > 0 ||
+			m.Is(`math[display="block"]`)
+
+		if display {
+			tex = "$$" + tex + "$$"
+		} else {
+			tex = "$" + tex + "$"
+		}
+		m.ReplaceWithHtml(html.EscapeString(tex))
+	})
 }
 
 func (e *ExtractTextWiki) Stage(ctx context.Context, in chan Task) chan Task {
@@ -64,6 +247,10 @@ func (e *ExtractTextWiki) Stage(ctx context.Context, in chan Task) chan Task {
 
     go func() {
         defer close(out)
+
+        // Canonical URLs already emitted, so redirects don't duplicate articles
+        seen := make(map[string]bool)
+
         for task := range in {
             select {
             case <-ctx.Done():
@@ -79,33 +266,51 @@ func (e *ExtractTextWiki) Stage(ctx context.Context, in chan Task) chan Task {
                 return
             }
 
+            // Drop unwanted page kinds and repeated articles behind redirects
+            page := classifyWikiPage(doc)
+            if slices.Contains(e.DropKinds, page.Kind) {
+                log.Printf("Skipping %s page: %s\n", page.Kind, task.URL)
+                continue
+            }
+            key := page.CanonicalURL
+            if key == "" {
+                key = task.URL
+            }
+            if seen[key] {
+                log.Printf("Skipping duplicate of %s: %s\n", key, task.URL)
+                continue
+            }
+            seen[key] = true
+
             var sb strings.Builder
 
             // ---------------------------------------------------------
             // 0. Extract Main Page Title (The H1)
             // ---------------------------------------------------------
-            // Wikipedia titles usually have the ID "firstHeading"
-            pageTitle := doc.Find("#firstHeading").First()
+            layout := detectWikiLayout(doc)
+            pageTitle, selection := wikiTitleAndContent(doc, layout)
 
-            // Fallback for some skins or mobile views
-            if pageTitle.Length() == 0 {
-                pageTitle = doc.Find("h1").First()
+            // The displayed title keeps its casing ("iPhone"); the canonical title
+            // is only a fallback, its first letter is always upper case
+            titleText := cleanText(pageTitle)
+            if titleText == "" {
+                titleText = page.Title
             }
-
-            titleText := cleanText(pageTitle.Text())
             if titleText != "" {
                 // Formatting it as an H1 Markdown header
                 sb.WriteString("# " + titleText + "\n\n")
             }
 
-            // 1. Target the main content
-            selection := doc.Find(".mw-parser-output")
-            if selection.Length() == 0 {
-                selection = doc.Find("#mw-content-text")
-            }
+            // 1. Keep formulas as LaTeX before text gets flattened
+            replaceMathWithLaTeX(selection)
 
             // 2. Remove Junk
             selection.Find(".mw-editsection, #toc, .toc, .infobox, .thumb, .reference, .noprint, .refbegin, .reflist, script, style, table, .mw-empty-elt").Remove()
+            selection.Find(".mw-ref, .mw-references-wrap, .mw-references, figure, .pcs-edit-section-link-container, .pcs-collapse-table-container, .pcs-fold-hr").Remove()
+            if layout == layoutMobileHTML {
+                // The page header repeats the title and the short description
+                selection.Find("header").Remove()
+            }
 
             stopReading := false
             contentTags := "h2, h3, h4, h5, h6, p, ul, ol, dl, blockquote"
@@ -139,6 +344,18 @@ func (e *ExtractTextWiki) Stage(ctx context.Context, in chan Task) chan Task {
                     return false
                 }
 
+                // --- LISTS ---
+                // Nested lists and paragraphs inside items are rendered by their outermost list
+                if s.ParentsFiltered("ul, ol, dl").Length() > 0 {
+                    return true
+                }
+                if tag == "ul" || tag == "ol" || tag == "dl" {
+                    if list := renderList(s, ""); list != "" {
+                        sb.WriteString(list + "\n\n")
+                    }
+                    return true
+                }
+
                 // --- BODY CONTENT ---
                 text := cleanText(s.Text())
                 if text != "" {
@@ -148,14 +365,249 @@ func (e *ExtractTextWiki) Stage(ctx context.Context, in chan Task) chan Task {
                 return true
             })
 
-            select {
-            case <-ctx.Done():
-                log.Println("Stopping text extraction due to ctx cancelled")
-                return
-            case out <- Task{ID: task.ID, URL: task.URL, Content: strings.TrimSpace(sb.String())}:
+            article := strings.TrimSpace(sb.String())
+
+            metadata := map[string]string{"kind": page.Kind, "title": titleText, "layout": layout}
+            if page.CanonicalURL != "" {
+                metadata["canonical_url"] = page.CanonicalURL
+            }
+
+            // Keyed by the canonical page, like the dedup above. Chunks add their
+            // section, their place in it and the budget, so an edit elsewhere in the
+            // article doesn't renumber them.
+            samples := []Task{{ID: SampleID("wiki", key), Content: article}}
+            if e.ChunkTokens > 0 {
+                samples = nil
+                seen := make(map[string]int)
+                for _, chunk := range chunkArticle(titleText, article, e.ChunkTokens) {
+                    id := SampleID("wiki", key, chunk.Section, strconv.Itoa(seen[chunk.Section]), strconv.Itoa(e.ChunkTokens))
+                    seen[chunk.Section]++
+                    samples = append(samples, Task{ID: id, Content: chunk.Text})
+                }
+            }
+            for _, sample := range samples {
+                sample.URL = task.URL
+                sample.Metadata = maps.Clone(metadata)
+                select {
+                case <-ctx.Done():
+                    log.Println("Stopping text extraction due to ctx cancelled")
+                    return
+                case out <- sample:
+                }
             }
         }
     }()
     return out
 }
 
+
+// renderList renders ul/ol elements as Markdown bullets and numbered items, with nested
+// lists indented below their item, and dl elements as "term: definition" lines.
+func renderList(list *goquery.Selection, indent string) string {
+	var lines []string
+
+	// itemText is the single-line text of an item without its nested lists
+	itemText := func(item *goquery.Selection) string {
+		c := item.Clone()
+		c.Find("ul, ol, dl").Remove()
+		return strings.Join(strings.Fields(c.Text()), " ")
+	}
+
+	// nested renders the lists that belong directly to item
+	nested := func(item *goquery.Selection, childIndent string) {
+		item.Find("ul, ol, dl").Each(func(i int, sub *goquery.Selection) {
+			if sub.Parent().Closest("li, dt, dd").IsSelection(item) {
+				if text := renderList(sub, childIndent); text != "" {
+					lines = append(lines, text)
+				}
+			}
+		})
+	}
+
+	switch goquery.NodeName(list) {
+	case "ul", "ol":
+		ordered := goquery.NodeName(list) == "ol"
+		n := 0
+		if start, err := strconv.Atoi(list.AttrOr("start", "1")); err == nil {
+			n = start - 1
+		}
+		list.ChildrenFiltered("li").Each(func(i int, li *goquery.Selection) {
+			marker := "-"
+			if ordered {
+				n++
+				marker = strconv.Itoa(n) + "."
+			}
+			if text := itemText(li); text != "" {
+				lines = append(lines, indent+marker+" "+text)
+			}
+			nested(li, indent+strings.Repeat(" ", len(marker)+1))
+		})
+
+	case "dl":
+		// A term applies to every definition that follows it
+		term, defined := "", false
+		list.Children().Each(func(i int, item *goquery.Selection) {
+			switch goquery.NodeName(item) {
+			case "dt":
+				if term != "" && !defined {
+					lines = append(lines, indent+term)
+				}
+				term, defined = itemText(item), false
+				nested(item, indent+"  ")
+			case "dd":
+				text := itemText(item)
+				switch {
+				case term != "" && text != "":
+					lines = append(lines, indent+term+": "+text)
+					defined = true
+				case text != "":
+					lines = append(lines, indent+text)
+				}
+				nested(item, indent+"  ")
+			}
+		})
+		if term != "" && !defined {
+			lines = append(lines, indent+term)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// countTokens approximates the token count the same way analyze_dataset.py does
+func countTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+// articleChunk is one sample of a chunked article
+type articleChunk struct {
+	Section string // "History > Early years", empty for the lead
+	Text    string
+}
+
+// chunkArticle splits an extracted article at its "##"/"###" headers into samples of
+// at most maxTokens tokens. Every sample starts with the article title and the path of
+// the section it was taken from. Consecutive parts of the same top-level section are
+// packed together; a section that is too long is split between paragraphs, and a
+// single paragraph that is too long is split between words.
+func chunkArticle(title, article string, maxTokens int) []articleChunk {
+	type section struct {
+		h2, h3 string
+		paras  []string
+	}
+
+	// Rebuild the section structure from the markdown written by the extractor
+	sections := []*section{{}}
+	var para []string
+	flushPara := func() {
+		if len(para) > 0 {
+			cur := sections[len(sections)-1]
+			cur.paras = append(cur.paras, strings.Join(para, "\n"))
+			para = nil
+		}
+	}
+	for _, line := range strings.Split(article, "\n") {
+		switch {
+		case strings.HasPrefix(line, "# "):
+			flushPara()
+		case strings.HasPrefix(line, "## "):
+			flushPara()
+			sections = append(sections, &section{h2: strings.TrimPrefix(line, "## ")})
+		case strings.HasPrefix(line, "### "):
+			flushPara()
+			parent := sections[len(sections)-1].h2
+			sections = append(sections, &section{h2: parent, h3: strings.TrimPrefix(line, "### ")})
+		case strings.TrimSpace(line) == "":
+			flushPara()
+		default:
+			para = append(para, line)
+		}
+	}
+	flushPara()
+
+	path := func(s *section) string {
+		path := s.h2
+		if s.h3 != "" {
+			if path != "" {
+				path += " > "
+			}
+			path += s.h3
+		}
+		return path
+	}
+	header := func(s *section) string {
+		h := "# " + title + "\n\n"
+		if path := path(s); path != "" {
+			h += "## " + path + "\n\n"
+		}
+		return h
+	}
+
+	var chunks []articleChunk
+	var start, last *section
+	var body []string
+	used := 0
+
+	flush := func() {
+		if len(body) > 0 {
+			chunks = append(chunks, articleChunk{Section: path(start), Text: header(start) + strings.Join(body, "\n\n")})
+		}
+		start, last, body, used = nil, nil, nil, 0
+	}
+	open := func(s *section) {
+		start, last = s, s
+		used = countTokens(header(s))
+	}
+
+	for _, s := range sections {
+		for _, p := range s.paras {
+			tokens := countTokens(p)
+
+			// A subsection joining the current sample brings its sub-header along,
+			// which has to fit the budget too
+			heading := ""
+			if s != last {
+				heading = "### " + s.h3
+			}
+
+			// Top-level sections never share a sample
+			newTopLevel := s != last && s.h3 == ""
+			if start != nil && (newTopLevel || start.h2 != s.h2 || used+countTokens(heading)+tokens > maxTokens) {
+				flush()
+			}
+			if start == nil {
+				open(s)
+			}
+
+			// Keep the sub-header when a new subsection joins the current sample
+			if s != last {
+				body = append(body, heading)
+				used += countTokens(heading)
+				last = s
+			}
+
+			if used+tokens <= maxTokens {
+				body = append(body, p)
+				used += tokens
+				continue
+			}
+
+			// Paragraph alone exceeds the budget, cut it between words
+			words := strings.Fields(p)
+			for len(words) > 0 {
+				room := max(maxTokens-used, 1)
+				n := min(room, len(words))
+				body = append(body, strings.Join(words[:n], " "))
+				used += n
+				words = words[n:]
+				if len(words) > 0 {
+					flush()
+					open(s)
+				}
+			}
+		}
+	}
+	flush()
+
+	return chunks
+}
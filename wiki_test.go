@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runStage feeds tasks through a single stage and collects its output
+func runStage(t *testing.T, stage Pipeline, tasks ...Task) []Task {
+	t.Helper()
+	in := make(chan Task, len(tasks))
+	for _, task := range tasks {
+		in <- task
+	}
+	close(in)
+
+	var out []Task
+	for task := range stage.Stage(context.Background(), in) {
+		out = append(out, task)
+	}
+	return out
+}
+
+func readFixture(t *testing.T, path ...string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(append([]string{"testdata"}, path...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestExtractTextWikiLayouts(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		layout   string
+		title    string
+		headers  []string
+		contains []string
+	}{
+		{
+			fixture:  "desktop.html",
+			layout:   layoutDesktop,
+			title:    "Go (programming language)",
+			headers:  []string{"## History", "## Design", "### Syntax"},
+			contains: []string{"Go is a statically typed", "concise and readable."},
+		},
+		{
+			fixture:  "mw-heading.html",
+			layout:   layoutDesktop,
+			title:    "iPhone",
+			headers:  []string{"## History", "## Hardware", "### Screen"},
+			contains: []string{"The iPhone is a line of smartphones", "multi-touch display."},
+		},
+		{
+			fixture:  "mobile.html",
+			layout:   layoutMobile,
+			title:    "Go (programming language)",
+			headers:  []string{"## History", "## Design", "### Syntax"},
+			contains: []string{"Go is a statically typed", "concise and readable."},
+		},
+		{
+			fixture:  "parsoid.html",
+			layout:   layoutParsoid,
+			title:    "Go (programming language)",
+			headers:  []string{"## History", "## Design", "### Syntax"},
+			contains: []string{"Go is a statically typed", "concise and readable."},
+		},
+		{
+			fixture:  "mobile-html.html",
+			layout:   layoutMobileHTML,
+			title:    "Go (programming language)",
+			headers:  []string{"## History", "## Design", "### Syntax"},
+			contains: []string{"Go is a statically typed", "concise and readable."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			task := Task{URL: "https://en.wikipedia.org/wiki/" + tt.fixture, Content: readFixture(t, "wiki", tt.fixture)}
+			out := runStage(t, &ExtractTextWiki{}, task)
+			if len(out) != 1 {
+				t.Fatalf("got %d samples, want 1", len(out))
+			}
+			sample := out[0]
+
+			if got := sample.Metadata["layout"]; got != tt.layout {
+				t.Errorf("layout = %q, want %q", got, tt.layout)
+			}
+			if got := sample.Metadata["title"]; got != tt.title {
+				t.Errorf("title = %q, want %q", got, tt.title)
+			}
+			if !strings.HasPrefix(sample.Content, "# "+tt.title+"\n\n") {
+				t.Errorf("content does not start with the title header:\n%s", sample.Content)
+			}
+
+			// Headers in document order
+			pos := 0
+			for _, header := range tt.headers {
+				i := strings.Index(sample.Content[pos:], header+"\n")
+				if i < 0 {
+					t.Errorf("header %q missing or out of order:\n%s", header, sample.Content)
+					break
+				}
+				pos += i + len(header)
+			}
+			for _, text := range tt.contains {
+				if !strings.Contains(sample.Content, text) {
+					t.Errorf("content misses %q:\n%s", text, sample.Content)
+				}
+			}
+
+			// Extraction stops at the References footer
+			for _, text := range []string{"References", "REFERENCE TEXT", "External links", "Official website", "edit"} {
+				if strings.Contains(sample.Content, text) {
+					t.Errorf("content contains %q:\n%s", text, sample.Content)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTextWikiChunkIDs(t *testing.T) {
+	task := Task{URL: "https://en.wikipedia.org/wiki/Go_(programming_language)", Content: readFixture(t, "wiki", "desktop.html")}
+	whole := runStage(t, &ExtractTextWiki{}, task)
+	chunks := runStage(t, &ExtractTextWiki{ChunkTokens: 40}, task)
+	if len(whole) != 1 || len(chunks) < 2 {
+		t.Fatalf("got %d articles and %d chunks", len(whole), len(chunks))
+	}
+
+	ids := map[string]bool{whole[0].ID: true}
+	for _, chunk := range chunks {
+		if ids[chunk.ID] {
+			t.Errorf("duplicate id %q", chunk.ID)
+		}
+		ids[chunk.ID] = true
+	}
+
+	// The same chunk under another budget is another sample
+	again := runStage(t, &ExtractTextWiki{ChunkTokens: 40}, task)
+	other := runStage(t, &ExtractTextWiki{ChunkTokens: 41}, task)
+	if again[0].ID != chunks[0].ID || other[0].ID == chunks[0].ID {
+		t.Errorf("chunk ids: %q, rerun %q, other budget %q", chunks[0].ID, again[0].ID, other[0].ID)
+	}
+}
+
+func TestExtractTextWikiMath(t *testing.T) {
+	out := runStage(t, &ExtractTextWiki{}, Task{URL: "https://en.wikipedia.org/wiki/Pythagorean_theorem", Content: readFixture(t, "wiki", "math.html")})
+	if len(out) != 1 {
+		t.Fatalf("got %d samples, want 1", len(out))
+	}
+	content := out[0].Content
+
+	for _, want := range []string{
+		"The theorem states that $a^{2}+b^{2}=c^{2}$ for a right triangle with legs $a$ and b.",
+		"Solving for the hypotenuse gives\n\n$$c={\\sqrt {a^{2}+b^{2}}}.$$",
+		"the same formula as $$a^{2}=c^{2}-b^{2}$$ without a wrapper.",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("missing %q in:\n%s", want, content)
+		}
+	}
+	for _, unwanted := range []string{`\displaystyle`, `\textstyle`, "REFERENCE TEXT"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("content contains %q:\n%s", unwanted, content)
+		}
+	}
+}
+
+func TestChunkArticleBudget(t *testing.T) {
+	// The sub-header of a joining subsection counts against the budget
+	got := chunkArticle("T", "## A\nw1 w2 w3 w4 w5\n\n### A1\nx", 10)
+	want := []articleChunk{
+		{Section: "A", Text: "# T\n\n## A\n\nw1 w2 w3 w4 w5"},
+		{Section: "A > A1", Text: "# T\n\n## A > A1\n\nx"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	article := runStage(t, &ExtractTextWiki{}, Task{Content: readFixture(t, "wiki", "desktop.html")})[0].Content
+	for _, budget := range []int{20, 40, 80, 400} {
+		for _, chunk := range chunkArticle("Go (programming language)", article, budget) {
+			if n := countTokens(chunk.Text); n > budget {
+				t.Errorf("budget %d: %d tokens in chunk %q", budget, n, chunk.Text)
+			}
+		}
+	}
+}
+
+func TestExtractTextWikiLists(t *testing.T) {
+	out := runStage(t, &ExtractTextWiki{}, Task{URL: "https://en.wikipedia.org/wiki/Go_toolchain", Content: readFixture(t, "wiki", "lists.html")})
+	if len(out) != 1 {
+		t.Fatalf("got %d samples, want 1", len(out))
+	}
+	content := out[0].Content
+
+	for _, want := range []string{
+		"## Commands\n- Build tools\n  - go build compiles packages\n  - go install installs binaries\n    1. into GOBIN\n    2. or GOPATH/bin\n- Test tools\n",
+		"## Release steps\n3. Freeze the tree\n4. Tag the release\n",
+		"## Glossary\nGOROOT: The root of the Go installation.\nGOPATH: The workspace directory.\nGOPATH: Defaults to $HOME/go.\nGOOS",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("missing %q in:\n%s", want, content)
+		}
+	}
+	if strings.Contains(content, "Gopher") {
+		t.Errorf("See also was extracted:\n%s", content)
+	}
+}
+
+func TestExtractTextWikiPageKinds(t *testing.T) {
+	fixtures := map[string]string{
+		"desktop.html":        PageArticle,
+		"disambiguation.html": PageDisambiguation,
+		"stub.html":           PageStub,
+		"list.html":           PageList,
+	}
+	var tasks []Task
+	for fixture := range fixtures {
+		tasks = append(tasks, Task{URL: "https://en.wikipedia.org/wiki/" + fixture, Content: readFixture(t, "wiki", fixture)})
+	}
+
+	kinds := map[string]string{}
+	for _, task := range runStage(t, &ExtractTextWiki{}, tasks...) {
+		kinds[task.Metadata["kind"]] = task.Metadata["title"]
+	}
+	want := map[string]string{
+		PageArticle:        "Go (programming language)",
+		PageDisambiguation: "Go",
+		PageStub:           "gofmt",
+		PageList:           "List of Go compilers",
+	}
+	if !maps.Equal(kinds, want) {
+		t.Errorf("kinds = %q, want %q", kinds, want)
+	}
+
+	var kept []string
+	for _, task := range runStage(t, &ExtractTextWiki{DropKinds: []string{PageDisambiguation, PageStub}}, tasks...) {
+		kept = append(kept, task.Metadata["kind"])
+	}
+	slices.Sort(kept)
+	if want := []string{PageArticle, PageList}; !slices.Equal(kept, want) {
+		t.Errorf("kept %q, want %q", kept, want)
+	}
+}
+
+func TestExtractTextWikiRedirects(t *testing.T) {
+	// Both URLs redirect to the same article and carry its canonical link
+	content := readFixture(t, "wiki", "desktop.html")
+	out := runStage(t, &ExtractTextWiki{},
+		Task{URL: "https://en.wikipedia.org/wiki/Golang", Content: content},
+		Task{URL: "https://en.wikipedia.org/wiki/Go_language", Content: content},
+	)
+	if len(out) != 1 {
+		t.Fatalf("got %d samples, want 1", len(out))
+	}
+	if got := out[0].Metadata["canonical_url"]; got != "https://en.wikipedia.org/wiki/Go_(programming_language)" {
+		t.Errorf("canonical_url = %q", got)
+	}
+}